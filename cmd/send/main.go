@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/urfave/cli/v2"
 
@@ -14,19 +17,185 @@ import (
 
 func main() {
 	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "config",
+				Value: GetConfigPath(),
+				Usage: "Path to a JSON config file with api_url, repository, branch, installation_id and store_path",
+			},
+			&cli.StringFlag{
+				Name:  "api-url",
+				Usage: "Base URL of the GitHub Enterprise API",
+			},
+			&cli.StringFlag{
+				Name:  "repo",
+				Usage: "Devops repository in OWNER/NAME form",
+			},
+			&cli.StringFlag{
+				Name:  "branch",
+				Usage: "Branch of the devops repository to read and commit to",
+			},
+			&cli.Int64Flag{
+				Name:  "installation-id",
+				Usage: "GitHub App installation ID. Looked up from the repository if unset",
+			},
+			&cli.StringFlag{
+				Name:  "store",
+				Usage: "Use a local bare git repository or directory instead of GitHub",
+			},
+		},
+		Before: func(c *cli.Context) error {
+			config, err := LoadConfig(c.String("config"))
+			if err != nil {
+				return fmt.Errorf("%s: %w", err, ErrInvalidInput)
+			}
+
+			if c.IsSet("api-url") {
+				config.APIURL = c.String("api-url")
+			}
+			if c.IsSet("repo") {
+				config.Repository = c.String("repo")
+			}
+			if c.IsSet("branch") {
+				config.Branch = c.String("branch")
+			}
+			if c.IsSet("installation-id") {
+				config.InstallationID = c.Int64("installation-id")
+			}
+			if c.IsSet("store") {
+				config.StorePath = c.String("store")
+			}
+
+			Configure(config)
+			return nil
+		},
 		Commands: []*cli.Command{
 			{
 				Name:  "login",
 				Usage: "Login to an account",
+				Flags: []cli.Flag{&cli.DurationFlag{
+					Name:  "ttl",
+					Value: 7 * 24 * time.Hour,
+					Usage: "How long the session stays valid, e.g. 12h",
+				}},
+				Action: func(c *cli.Context) error {
+					username, password, err := Login()
+					if err != nil {
+						return err
+					}
+					user, err := VerifyUser(username, password)
+					if errors.Is(err, ErrInvalidCredentials) && VerifyResetCode(username, password) == nil {
+						fmt.Println("\nYou logged in with a password reset code. Choose a new password.")
+						var hash string
+						hash, err = PromptNewPassword(username, "New password: ")
+						if err != nil {
+							fmt.Println()
+							return err
+						}
+						user, err = RedeemResetCode(username, password, hash)
+					}
+					if err != nil {
+						fmt.Println()
+						return err
+					}
+					session, err := WriteUser(user, c.Duration("ttl"))
+					if err != nil {
+						return err
+					}
+					fmt.Printf("\nLogin Succeeded. Session expires at %s\n", session.ExpiresAt.Format(time.RFC1123))
+					return nil
+				},
+			},
+			{
+				Name:  "passwd",
+				Usage: "Change the password of your account",
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
+					session, err := GetSession()
+					if err != nil {
+						return err
+					}
+					entry.User = session.Username
+
+					password, err := PromptCurrentPassword()
+					if err != nil {
+						fmt.Println()
+						return err
+					}
+					if _, err := VerifyUser(session.Username, password); err != nil {
+						fmt.Println()
+						return err
+					}
+					hash, err := PromptNewPassword(session.Username, "\nNew password: ")
+					if err != nil {
+						fmt.Println()
+						return err
+					}
+
+					user, err := SetPassword(session.Username, hash)
+					if err != nil {
+						fmt.Println()
+						return err
+					}
+					// Changing the password invalidated the current session, so
+					// sign a new one that expires at the same time.
+					if _, err := WriteUser(user, time.Until(session.ExpiresAt)); err != nil {
+						return err
+					}
+
+					fmt.Println("\nPassword changed")
+					return nil
+				}),
+			},
+			{
+				Name:      "reset-password",
+				Usage:     "Issue a one-time code a user can log in with to choose a new password",
+				UsageText: "send reset-password [--ttl DURATION] [USERNAME]",
+				Flags: []cli.Flag{&cli.DurationFlag{
+					Name:  "ttl",
+					Value: 24 * time.Hour,
+					Usage: "How long the reset code stays valid",
+				}},
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
+					if c.NArg() != 1 {
+						return usageError(c, `"send reset-password" requires exactly 1 argument.`)
+					}
+					username, err := requireAdmin()
+					if err != nil {
+						return err
+					}
+
+					user := c.Args().First()
+					entry.User = username
+					code, err := IssueResetCode(user, c.Duration("ttl"))
+					if err != nil {
+						return err
+					}
+
+					fmt.Printf("Reset code for %s: %s\n", user, code)
+					fmt.Printf("They can use it once as their password with \"send login\" within %s.\n", c.Duration("ttl"))
+					notify(Notification{Text: fmt.Sprintf("User %s issued a password reset code for %s.", username, user), User: username})
+					return nil
+				}),
+			},
+			{
+				Name:  "whoami",
+				Usage: "Show the user this session is logged in as",
 				Action: func(c *cli.Context) error {
-					username, password := Login()
-					_, success := VerifyUser(username, password)
-					if success {
-						fmt.Println("\nLogin Succeeded")
-						WriteUser(username)
+					session, err := GetSession()
+					if err != nil {
+						return err
+					}
+					user, err := GetUser(session.Username)
+					if err != nil {
+						return err
+					}
+
+					if user.IsAdmin {
+						fmt.Printf("Logged in as %s (admin)\n", user.Username)
 					} else {
-						fmt.Println("\nUsername doesn't exist or password is incorrect")
+						fmt.Printf("Logged in as %s\n", user.Username)
 					}
+					fmt.Printf("Session issued at %s, expires at %s\n", session.IssuedAt.Format(time.RFC1123), session.ExpiresAt.Format(time.RFC1123))
 					return nil
 				},
 			},
@@ -34,15 +203,18 @@ func main() {
 				Name:  "logout",
 				Usage: "Logout of your account",
 				Action: func(c *cli.Context) error {
-					ClearCurrentUser()
-					return nil
+					return ClearCurrentUser()
 				},
 			},
 			{
 				Name:  "apps",
 				Usage: "List all apps",
 				Action: func(c *cli.Context) error {
-					fmt.Println("All apps: " + strings.Join(GetApps(), ", "))
+					apps, err := GetApps()
+					if err != nil {
+						return err
+					}
+					fmt.Println("All apps: " + strings.Join(apps, ", "))
 					return nil
 				},
 			},
@@ -50,19 +222,22 @@ func main() {
 				Name:  "ls",
 				Usage: "List the apps this account has access to",
 				Action: func(c *cli.Context) error {
-					username := GetCurrentUser()
-					if username == "" {
-						return cli.Exit("Login required", 1)
+					username, err := GetCurrentUser()
+					if err != nil {
+						return err
+					}
+					user, err := GetUser(username)
+					if err != nil {
+						return err
+					}
+
+					apps := user.AppRoles()
+					if user.IsAdmin {
+						fmt.Println("You have access to all apps. Use the \"apps\" command to see all available apps.")
+					} else if len(apps) == 0 {
+						fmt.Println("You don't have access to any apps.")
 					} else {
-						user := GetUser(username)
-						apps := user.Apps
-						if user.IsAdmin {
-							fmt.Println("You have access to all apps. Use the \"apps\" command to see all available apps.")
-						} else if len(apps) == 0 {
-							fmt.Println("You don't have access to any apps.")
-						} else {
-							fmt.Println("You have access to the following apps: " + strings.Join(apps, ", "))
-						}
+						fmt.Println("You have access to the following apps: " + strings.Join(apps, ", "))
 					}
 					return nil
 				},
@@ -70,36 +245,173 @@ func main() {
 			{
 				Name:  "signup",
 				Usage: "Create an account",
-				Action: func(c *cli.Context) error {
-					username, password := Signup()
-					RegisterUser(username, password)
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
+					username, password, err := Signup()
+					if err != nil {
+						fmt.Println()
+						return err
+					}
+					entry.User = username
+					if err := RegisterUser(username, password); err != nil {
+						fmt.Println()
+						return err
+					}
 
 					fmt.Println("\nNew user registered with username " + username)
-					SendToSlack(fmt.Sprintf("User %s just signed up.", username))
+					notify(Notification{Text: fmt.Sprintf("User %s just signed up.", username), User: username})
 					return nil
-				},
+				}),
 			},
 			{
 				Name:      "add",
 				Usage:     "Grant a given user access to an app",
-				UsageText: "send add [USERNAME] [APP]",
-				Action: func(c *cli.Context) error {
+				UsageText: "send add [--role ROLE] [USERNAME] [APP]",
+				Flags: []cli.Flag{&cli.StringFlag{
+					Name:  "role",
+					Value: RoleDeployer,
+					Usage: "Role to grant. viewer can pull configs and read logs, deployer can also push configs, deploy and exec, app-admin can also grant access to the app",
+				}},
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
 					if c.NArg() < 2 {
-						fmt.Println(`"send add" requires exactly 2 argument.`)
-						cli.ShowCommandHelp(c, c.Command.Name)
+						return usageError(c, `"send add" requires exactly 2 argument.`)
+					}
+					user := c.Args().Get(0)
+					app := c.Args().Get(1)
+					role := c.String("role")
+
+					entry.App = app
+
+					username, err := requirePermission(app, PermGrantAccess)
+					if err != nil {
+						return err
+					}
+					entry.User = username
+					if err := GrantRole(user, app, role); err != nil {
+						return err
+					}
+
+					fmt.Printf("Granted user %s %s access to %s\n", user, role, app)
+					notify(Notification{Text: fmt.Sprintf("User %s granted user %s %s access to %s.", username, user, role, app), User: username, App: app})
+					return nil
+				}),
+			},
+			{
+				Name:      "remove",
+				Usage:     "Revoke a given user's access to an app, or to all apps with --all",
+				UsageText: "send remove [USERNAME] [APP]\n   send remove --all [USERNAME]",
+				Flags: []cli.Flag{&cli.BoolFlag{
+					Name:  "all",
+					Usage: "Revoke access to every app",
+				}},
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
+					if c.Bool("all") && c.NArg() != 1 {
+						return usageError(c, `"send remove --all" requires exactly 1 argument.`)
+					}
+					if !c.Bool("all") && c.NArg() != 2 {
+						return usageError(c, `"send remove" requires exactly 2 arguments.`)
+					}
+					user := c.Args().Get(0)
+					var apps []string
+					var username string
+					var err error
+					if c.Bool("all") {
+						username, err = requireAdmin()
 					} else {
-						username := GetCurrentUser()
-						if GetUser(username).IsAdmin {
-							user := c.Args().Get(0)
-							app := c.Args().Get(1)
-							AddApp(user, app)
-
-							fmt.Printf("Granted user %s access to %s\n", user, app)
-							SendToSlack(fmt.Sprintf("User %s granted user %s access to %s.", username, user, app))
+						apps = []string{c.Args().Get(1)}
+						entry.App = apps[0]
+						username, err = requirePermission(apps[0], PermGrantAccess)
+					}
+					if err != nil {
+						return err
+					}
+					entry.User = username
+
+					removed, err := RemoveApps(user, apps)
+					if err != nil {
+						return err
+					}
+					if len(removed) == 0 {
+						fmt.Printf("User %s has no access to revoke\n", user)
+						return nil
+					}
+
+					fmt.Printf("Revoked user %s's access to %s\n", user, strings.Join(removed, ", "))
+					notify(Notification{Text: fmt.Sprintf("User %s revoked user %s's access to %s.", username, user, strings.Join(removed, ", ")), User: username, App: entry.App})
+					return nil
+				}),
+			},
+			{
+				Name:  "migrate-users",
+				Usage: "Upgrade every user file in the devops repo to the current schema",
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
+					username, err := requireAdmin()
+					if err != nil {
+						return err
+					}
+					entry.User = username
+
+					migrated, err := MigrateUsers()
+					if err != nil {
+						return err
+					}
+					if len(migrated) == 0 {
+						fmt.Println("All users are already up to date.")
+						return nil
+					}
+					fmt.Println("Migrated users: " + strings.Join(migrated, ", "))
+					return nil
+				}),
+			},
+			{
+				Name:      "audit",
+				Usage:     "Show the audit log of mutating send commands",
+				UsageText: "send audit [--app APP] [--user USERNAME] [--since DURATION_OR_DATE]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "app",
+						Usage: "Only show entries for this app",
+					},
+					&cli.StringFlag{
+						Name:  "user",
+						Usage: "Only show entries by this user",
+					},
+					&cli.StringFlag{
+						Name:  "since",
+						Usage: "Only show entries newer than a duration ago (e.g. 72h) or a date (e.g. 2020-03-01)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					filter := AuditFilter{App: c.String("app"), User: c.String("user")}
+					if since := c.String("since"); since != "" {
+						if duration, err := time.ParseDuration(since); err == nil {
+							filter.Since = time.Now().Add(-duration)
+						} else if date, err := time.Parse("2006-01-02", since); err == nil {
+							filter.Since = date
 						} else {
-							fmt.Println("You do not have admin access.")
+							return usageError(c, fmt.Sprintf("Could not parse --since %q.", since))
 						}
 					}
+
+					// App admins may read the log of their own app
+					if filter.App != "" {
+						if _, err := requirePermission(filter.App, PermGrantAccess); err != nil {
+							return err
+						}
+					} else if _, err := requireAdmin(); err != nil {
+						return err
+					}
+
+					entries, err := GetAuditLog(filter)
+					if err != nil {
+						return err
+					}
+					for _, entry := range entries {
+						commit := entry.Commit
+						if len(commit) > 7 {
+							commit = commit[:7]
+						}
+						fmt.Printf("%s  %-12s %-15s %-15s %-8s %s  [%s]\n", entry.Time.Local().Format("2006-01-02 15:04:05"), entry.User, entry.Command, entry.App, commit, entry.Result, strings.Join(entry.Args, " "))
+					}
 					return nil
 				},
 			},
@@ -109,111 +421,543 @@ func main() {
 				UsageText: "send pull [APP]",
 				Action: func(c *cli.Context) error {
 					if c.NArg() < 1 {
-						fmt.Println(`"send pull" requires exactly 1 arguments.`)
-						cli.ShowCommandHelp(c, c.Command.Name)
-					} else {
-						app := c.Args().Get(0)
+						return usageError(c, `"send pull" requires exactly 1 arguments.`)
+					}
+					app := c.Args().Get(0)
 
-						success := GetAppConfiguration(app)
-						if success {
-							fmt.Printf("Downloaded successfully the configuration for %q", app)
-						} else {
-							fmt.Printf("Something went wrong while downloading the configuration for %q", app)
-						}
+					if _, err := requirePermission(app, PermReadConfig); err != nil {
+						return err
+					}
+					if err := GetAppConfiguration(app); err != nil {
+						return fmt.Errorf("something went wrong while downloading the configuration for %q: %w", app, err)
 					}
+					fmt.Printf("Downloaded successfully the configuration for %q\n", app)
 					return nil
 				},
 			},
 			{
-				Name:      "push",
-				Usage:     "Push a config file for an app. If the file exists on GitHub, it will be updated according. Otherwise, a new file will be created on GitHub.",
-				UsageText: "send push [APP] [FILE_PATH]",
+				Name:      "diff",
+				Usage:     "Show how the local and server copies of an app's config differ from the devops repo",
+				UsageText: "send diff [--local DIR] [--skip-local] [--skip-server] [APP] [FILE]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "local",
+						Usage: "Directory with the local copies (default: config/APP, where send pull puts them)",
+					},
+					&cli.BoolFlag{
+						Name:  "skip-local",
+						Usage: "Only compare the repo with the server",
+					},
+					&cli.BoolFlag{
+						Name:  "skip-server",
+						Usage: "Only compare the local copies with the repo",
+					},
+				},
 				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 || c.NArg() > 2 {
+						return usageError(c, `"send diff" requires 1 or 2 arguments.`)
+					}
+					app := c.Args().Get(0)
+
+					if _, err := requirePermission(app, PermReadConfig); err != nil {
+						return err
+					}
+					differ, err := DiffApp(app, c.Args().Get(1), DiffOptions{
+						LocalDir:   c.String("local"),
+						SkipLocal:  c.Bool("skip-local"),
+						SkipServer: c.Bool("skip-server"),
+					})
+					if err != nil {
+						return err
+					}
+					if differ {
+						return fmt.Errorf("%s: %w", app, ErrConfigDiffers)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "push",
+				Usage:     "Push config files for an app as a single commit and copy them to the app's server. A directory pushes every file in it.",
+				UsageText: "send push [--review] [APP] [FILE_OR_DIR...]",
+				Flags: []cli.Flag{&cli.BoolFlag{
+					Name:  "review",
+					Usage: "Open a pull request for an admin to approve instead of pushing directly",
+				}},
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
 					if c.NArg() < 2 {
-						fmt.Println(`"send push" requires exactly 2 arguments.`)
-						cli.ShowCommandHelp(c, c.Command.Name)
-					} else {
-						app := c.Args().Get(0)
-						filePath := c.Args().Get(1)
-						username := GetCurrentUser()
+						return usageError(c, `"send push" requires at least 2 arguments.`)
+					}
+					app := c.Args().Get(0)
 
-						if username == "" {
-							return cli.Exit("Login required", 1)
-						} else {
-							if HasAccessTo(username, app) {
-								PushAppConfiguration(username, app, filePath)
+					entry.App = app
 
-								fileName := filepath.Base(filePath)
+					username, err := requirePermission(app, PermPushConfig)
+					if err != nil {
+						return err
+					}
+					entry.User = username
 
-								fmt.Println(fmt.Sprintf("Pushed %s for %s", fileName, app))
-								SendToSlack(fmt.Sprintf("User %s pushed %s for %s", username, fileName, app))
-							} else {
-								fmt.Println("You don't have access to the specified app.")
-							}
+					review := c.Bool("review")
+					if !review {
+						if review, err = ReviewRequired(username, app); err != nil {
+							return err
+						}
+						if review {
+							fmt.Printf("Pushes to %s need to be reviewed, opening a pull request\n", app)
+						}
+					}
+					if review {
+						pr, err := ProposeAppConfiguration(username, app, c.Args().Tail())
+						if err != nil {
+							return err
+						}
+						fmt.Printf("Opened pull request #%d: %s\n", pr.Number, pr.Title)
+						if pr.URL != "" {
+							fmt.Println(pr.URL)
 						}
+						notify(Notification{Text: fmt.Sprintf("User %s opened pull request #%d for %s: %s", username, pr.Number, app, pr.Title), User: username, App: app})
+						return nil
+					}
+
+					names, err := PushAppConfiguration(username, app, c.Args().Tail())
+					if err != nil {
+						return err
+					}
+
+					fileNames := strings.Join(names, ", ")
+					fmt.Println(fmt.Sprintf("Pushed %s for %s", fileNames, app))
+					notify(Notification{Text: fmt.Sprintf("User %s pushed %s for %s", username, fileNames, app), User: username, App: app})
+					return nil
+				}),
+			},
+			{
+				Name:      "approve",
+				Usage:     "Merge a pull request opened by send push --review and copy its files to the app's server",
+				UsageText: "send approve [PR_NUMBER]",
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
+					if c.NArg() != 1 {
+						return usageError(c, `"send approve" requires exactly 1 argument.`)
+					}
+					number, err := strconv.Atoi(strings.TrimPrefix(c.Args().First(), "#"))
+					if err != nil {
+						return usageError(c, fmt.Sprintf("%q is not a pull request number.", c.Args().First()))
+					}
+
+					username, err := requireAdmin()
+					if err != nil {
+						return err
+					}
+					entry.User = username
+
+					app, pr, err := ApprovePullRequest(username, number)
+					entry.App = app
+					if err != nil {
+						return err
+					}
+					fmt.Printf("Merged #%d and copied its files to %s\n", number, app)
+					notify(Notification{Text: fmt.Sprintf("User %s approved pull request #%d for %s: %s", username, number, app, pr.Title), User: username, App: app})
+					return nil
+				}),
+			},
+			{
+				Name:      "require-review",
+				Usage:     "Make pushes to an app by users other than admins go through pull requests",
+				UsageText: "send require-review [--off] [APP]",
+				Flags: []cli.Flag{&cli.BoolFlag{
+					Name:  "off",
+					Usage: "Let users push directly again",
+				}},
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
+					if c.NArg() != 1 {
+						return usageError(c, `"send require-review" requires exactly 1 argument.`)
+					}
+					app := c.Args().First()
+					entry.App = app
+
+					username, err := requireAdmin()
+					if err != nil {
+						return err
+					}
+					entry.User = username
+
+					if err := SetRequireReview(username, app, !c.Bool("off")); err != nil {
+						return err
+					}
+					if c.Bool("off") {
+						fmt.Printf("Pushes to %s no longer need review\n", app)
+					} else {
+						fmt.Printf("Pushes to %s by users other than admins now need review\n", app)
+					}
+					return nil
+				}),
+			},
+			{
+				Name:      "deploy",
+				Usage:     "Deploy an app's docker-compose files to its swarm and wait for the services to come up",
+				UsageText: "send deploy [--timeout DURATION] [APP]",
+				Flags: []cli.Flag{&cli.DurationFlag{
+					Name:  "timeout",
+					Value: 5 * time.Minute,
+					Usage: "How long to wait for the services to converge",
+				}},
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
+					if c.NArg() != 1 {
+						return usageError(c, `"send deploy" requires exactly 1 argument.`)
+					}
+					app := c.Args().First()
+					entry.App = app
+
+					username, err := requirePermission(app, PermDeploy)
+					if err != nil {
+						return err
+					}
+					entry.User = username
+
+					if err := DeployApp(app, c.Duration("timeout")); err != nil {
+						notify(Notification{Text: fmt.Sprintf("User %s failed to deploy %s: %s", username, app, err), User: username, App: app})
+						return err
+					}
+					notify(Notification{Text: fmt.Sprintf("User %s deployed %s.", username, app), User: username, App: app})
+					return nil
+				}),
+			},
+			{
+				Name:      "history",
+				Usage:     "List the commits that changed an app's docker-compose files",
+				UsageText: "send history [APP] [FILE]",
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 || c.NArg() > 2 {
+						return usageError(c, `"send history" requires 1 or 2 arguments.`)
+					}
+					app := c.Args().Get(0)
+
+					if _, err := requirePermission(app, PermReadConfig); err != nil {
+						return err
+					}
+					revisions, err := GetConfigHistory(app, c.Args().Get(1))
+					if err != nil {
+						return err
+					}
+					for _, revision := range revisions {
+						message := strings.SplitN(revision.Message, "\n", 2)[0]
+						fmt.Printf("%.7s  %s  %-15s %s\n", revision.SHA, revision.Date.Local().Format("2006-01-02 15:04:05"), revision.Author, message)
 					}
 					return nil
 				},
 			},
+			{
+				Name:      "rollback",
+				Usage:     "Restore an app's docker-compose files to an earlier commit and copy them to the server",
+				UsageText: "send rollback --to SHA [--deploy] [APP]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "to",
+						Usage:    "Commit to restore the files of, as listed by send history",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "deploy",
+						Usage: "Deploy the app once the files are restored",
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Value: 5 * time.Minute,
+						Usage: "How long to wait for the services to converge with --deploy",
+					},
+				},
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
+					if c.NArg() != 1 {
+						return usageError(c, `"send rollback" requires exactly 1 argument.`)
+					}
+					app := c.Args().First()
+					entry.App = app
+
+					username, err := requirePermission(app, PermPushConfig)
+					if err != nil {
+						return err
+					}
+					if c.Bool("deploy") {
+						if _, err := requirePermission(app, PermDeploy); err != nil {
+							return err
+						}
+					}
+					entry.User = username
+
+					review, err := ReviewRequired(username, app)
+					if err != nil {
+						return err
+					}
+					if review {
+						fmt.Printf("Changes to %s need to be reviewed, opening a pull request\n", app)
+						pr, err := ProposeRollback(username, app, c.String("to"))
+						if err != nil {
+							return err
+						}
+						fmt.Printf("Opened pull request #%d: %s\n", pr.Number, pr.Title)
+						if pr.URL != "" {
+							fmt.Println(pr.URL)
+						}
+						if c.Bool("deploy") {
+							fmt.Println("Not deploying, deploy once the pull request is approved")
+						}
+						notify(Notification{Text: fmt.Sprintf("User %s opened pull request #%d for %s: %s", username, pr.Number, app, pr.Title), User: username, App: app})
+						return nil
+					}
+
+					changed, err := RollbackApp(username, app, c.String("to"))
+					if err != nil {
+						return err
+					}
+					if len(changed) == 0 {
+						fmt.Printf("The files of %s are already as of %s\n", app, c.String("to"))
+					} else {
+						fmt.Printf("Restored %s\n", strings.Join(changed, ", "))
+						notify(Notification{Text: fmt.Sprintf("User %s rolled back %s to %s.", username, app, c.String("to")), User: username, App: app})
+					}
+
+					if c.Bool("deploy") {
+						return DeployApp(app, c.Duration("timeout"))
+					}
+					return nil
+				}),
+			},
 			{
 				Name:      "exec",
 				Usage:     "Run a docker command on an app's deployment",
-				UsageText: "send exec [APP] [DOCKER_CMD]",
-				Action: func(c *cli.Context) error {
+				UsageText: "send exec [-t] [APP] [DOCKER_CMD]",
+				Flags: []cli.Flag{&cli.BoolFlag{
+					Name:    "tty",
+					Aliases: []string{"t"},
+					Usage:   "Allocate a terminal on the server for interactive commands like docker exec -it",
+				}},
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
 					if c.NArg() < 2 {
-						fmt.Println(`"send exec" requires exactly 2 arguments.`)
-						cli.ShowCommandHelp(c, c.Command.Name)
-					} else {
-						app := c.Args().Get(0)
-						cmd := c.Args().Tail()
-						username := GetCurrentUser()
+						return usageError(c, `"send exec" requires exactly 2 arguments.`)
+					}
+					app := c.Args().Get(0)
+					cmd := c.Args().Tail()
 
-						if username == "" {
-							return cli.Exit("Login required", 1)
-						} else {
-							if HasAccessTo(username, app) {
-								fmt.Println(ExecCmd(app, strings.Join(cmd, " ")))
-							} else {
-								fmt.Println("You don't have access to the specified app.")
-							}
-						}
+					entry.App = app
+
+					username, err := requirePermission(app, PermExec)
+					if err != nil {
+						return err
+					}
+					entry.User = username
 
+					status, err := ExecCmd(app, strings.Join(cmd, " "), c.Bool("tty"))
+					if err != nil {
+						return err
+					}
+					if status != 0 {
+						return &ExitStatusError{Status: status}
 					}
 					return nil
+				}),
+			},
+			{
+				Name:      "logs",
+				Usage:     "Show the logs of an app's services, prefixed with the service name when there are several",
+				UsageText: "send logs [--follow] [--since SINCE] [--tail N] [APP] [SERVICE...]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "follow",
+						Aliases: []string{"f"},
+						Usage:   "Keep streaming new log lines",
+					},
+					&cli.StringFlag{
+						Name:  "since",
+						Usage: "Only show logs since a timestamp (e.g. 2020-03-01T13:00:00) or relative to now (e.g. 30m)",
+					},
+					&cli.StringFlag{
+						Name:  "tail",
+						Value: "all",
+						Usage: "Number of lines to show from the end of each service's logs",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 {
+						return usageError(c, `"send logs" requires at least 1 argument.`)
+					}
+					app := c.Args().First()
+
+					if _, err := requirePermission(app, PermReadLogs); err != nil {
+						return err
+					}
+					return StreamLogs(app, c.Args().Tail(), LogOptions{
+						Follow: c.Bool("follow"),
+						Since:  c.String("since"),
+						Tail:   c.String("tail"),
+					})
 				},
 			},
 			{
 				Name:      "provision",
-				Usage:     "Creates a new server on DigitalOcean, generates config files, and runs Swarm CLI to setup new server correctly.",
-				UsageText: "send provision [FLAGS] [APP]",
-				Flags: []cli.Flag{&cli.StringFlag{
-					Name:  "size",
-					Value: "s-1vcpu-1gb",
-					Usage: "To specify the size of the DigitalOcean droplet to be created. Valid sizes include: \n\t" + strings.Join(GetValidSizeStrings(), "\n\t"),
-				}},
-				Action: func(c *cli.Context) error {
+				Usage:     "Creates a new server, generates config files, and runs Swarm CLI to setup new server correctly.",
+				UsageText: "send provision [FLAGS] APP\n   send provision --resume APP",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "provider",
+						Value: "digitalocean",
+						Usage: "Where to create the server: digitalocean, fake (pretends to, for local testing) or existing (a server you already have, see --ip)",
+					},
+					&cli.StringFlag{
+						Name:  "ip",
+						Usage: "IP of the server for the existing provider, or of the local SSH server for the fake one",
+					},
+					&cli.StringFlag{
+						Name:  "size",
+						Usage: "Size of the server to be created, see send sizes for valid sizes (default: s-1vcpu-1gb on DigitalOcean)",
+					},
+					&cli.StringFlag{
+						Name:  "region",
+						Usage: "Region to create the server in (default: nyc3 on DigitalOcean)",
+					},
+					&cli.StringFlag{
+						Name:  "image",
+						Usage: "Image to create the server from (default: ubuntu-18-04-x64 on DigitalOcean)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tag",
+						Usage: "Tag the server, can be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "vpc",
+						Usage: "ID or name of the VPC to put the server in, it must be in the same region",
+					},
+					&cli.BoolFlag{
+						Name:  "ipv6",
+						Usage: "Give the server an IPv6 address",
+					},
+					&cli.BoolFlag{
+						Name:  "monitoring",
+						Usage: "Install the provider's monitoring agent on the server",
+					},
+					&cli.BoolFlag{
+						Name:  "backups",
+						Usage: "Enable automatic backups of the server",
+					},
+					&cli.BoolFlag{
+						Name:  "resume",
+						Usage: "Continue an interrupted provisioning of APP where it stopped, with the provider and options it was started with",
+					},
+					&cli.BoolFlag{
+						Name:  "keep-on-failure",
+						Usage: "Leave whatever was created in place if provisioning fails, to debug it or continue with --resume",
+					},
+				},
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
 					if c.NArg() < 1 {
-						fmt.Println(`"send provision" requires exactly 1 arguments.`)
-						cli.ShowCommandHelp(c, c.Command.Name)
-					} else {
-						username := GetCurrentUser()
-						app := c.Args().First()
-
-						if GetUser(username).IsAdmin {
-							if !IsDropletSizeValid(c.String("size")) {
-								fmt.Println("The specified droplet size is invalid.")
-								cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
-							}
-							ProvisionServerForApp(app, c.String("size"))
-							AddApp(username, app)
-							SendToSlack(fmt.Sprintf("User %s provisioned a new server for %s.", username, app))
-						} else {
-							fmt.Println("You do not have admin access.")
+						return usageError(c, `"send provision" requires exactly 1 arguments.`)
+					}
+					app := c.Args().First()
+					entry.App = app
+
+					username, err := requireAdmin()
+					if err != nil {
+						return err
+					}
+					entry.User = username
+
+					if c.Bool("resume") {
+						if err := ResumeProvisioning(app, c.Bool("keep-on-failure")); err != nil {
+							return err
 						}
+					} else if err := provisionApp(c, app); err != nil {
+						return err
+					}
+					if err := GrantRole(username, app, RoleAppAdmin); err != nil {
+						return err
+					}
+					notify(Notification{Text: fmt.Sprintf("User %s provisioned a new server for %s.", username, app), User: username, App: app})
+					return nil
+				}),
+			},
+			{
+				Name:      "sizes",
+				Usage:     "List the server sizes a provider can provision",
+				UsageText: "send sizes [--provider PROVIDER] [--region REGION]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "provider",
+						Value: "digitalocean",
+						Usage: "Provider to list the sizes of",
+					},
+					&cli.StringFlag{
+						Name:  "region",
+						Usage: "Region to list the sizes available in (default: the provider's default region)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					provider, err := NewCloudProvider(c.String("provider"), "")
+					if err != nil {
+						return err
+					}
+					sizes, err := GetValidSizeStrings(provider, c.String("region"))
+					if err != nil {
+						return err
+					}
+					if len(sizes) == 0 {
+						fmt.Printf("The %s provider does not choose server sizes.\n", provider.Name())
+					}
+					for _, size := range sizes {
+						fmt.Println(size)
 					}
 					return nil
 				},
 			},
+			{
+				Name:      "destroy",
+				Usage:     "Destroy an app's server and remove the app from the devops repo and from every user's access",
+				UsageText: "send destroy APP",
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
+					if c.NArg() != 1 {
+						return usageError(c, `"send destroy" requires exactly 1 argument.`)
+					}
+					app := c.Args().First()
+					entry.App = app
+
+					username, err := requireAdmin()
+					if err != nil {
+						return err
+					}
+					entry.User = username
+
+					if err := DestroyApp(app); err != nil {
+						return err
+					}
+					fmt.Printf("Destroyed %s\n", app)
+					notify(Notification{Text: fmt.Sprintf("User %s destroyed %s.", username, app), User: username, App: app})
+					return nil
+				}),
+			},
+			{
+				Name:      "pin-host-key",
+				Usage:     "Trust the SSH host key an app's server presents now and refuse any other from then on",
+				UsageText: "send pin-host-key APP",
+				Action: audited(func(c *cli.Context, entry *AuditEntry) error {
+					if c.NArg() != 1 {
+						return usageError(c, `"send pin-host-key" requires exactly 1 argument.`)
+					}
+					app := c.Args().First()
+					entry.App = app
+
+					username, err := requireAdmin()
+					if err != nil {
+						return err
+					}
+					entry.User = username
+
+					fingerprint, err := PinHostKey(app)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("Pinned host key %s for %s\n", fingerprint, app)
+					notify(Notification{Text: fmt.Sprintf("User %s pinned host key %s for %s.", username, fingerprint, app), User: username, App: app})
+					return nil
+				}),
+			},
 		},
 	}
 
@@ -221,8 +965,170 @@ func main() {
 	app.Usage = "A CLI for interfacing with AppDev's deployments"
 	app.Version = "1.0.0"
 
+	// Close connections and undo partial work when interrupted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		interrupted := false
+		for sig := range signals {
+			// A command running on a server gets the first interrupt
+			if ForwardSignal(sig) {
+				continue
+			}
+			// Cleanups may wait for the command to stop, a second
+			// interrupt gives up on them
+			if interrupted {
+				os.Exit(130)
+			}
+			interrupted = true
+			fmt.Fprintln(os.Stderr, "\nInterrupted, cleaning up, interrupt again to quit at once")
+			go func() {
+				// A command that was stopped still has to return, so
+				// that what it did is audited, and exits with 130 then
+				if !RunCleanups() {
+					os.Exit(130)
+				}
+			}()
+		}
+	}()
+
 	err := app.Run(os.Args)
+	var exitErr *ExitStatusError
+	if errors.As(err, &exitErr) {
+		// The remote command has already reported its own failure
+		os.Exit(exitErr.Status)
+	}
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		os.Exit(exitCode(err))
+	}
+}
+
+// Exit codes are part of the CLI's interface for scripts, so existing values
+// must not be renumbered.
+var exitCodes = []struct {
+	err  error
+	code int
+}{
+	{ErrInvalidInput, 2},
+	{ErrLoginRequired, 3},
+	{ErrInvalidCredentials, 4},
+	{ErrAccessDenied, 5},
+	{ErrUserNotFound, 6},
+	{ErrAppNotFound, 7},
+	{ErrNotFound, 8},
+	{ErrConflict, 9},
+	{ErrStoreFailure, 10},
+	{ErrRemoteFailure, 11},
+	{ErrProviderFailure, 12},
+	{ErrHostKeyMismatch, 13},
+	{ErrConfigDiffers, 14},
+	{ErrInterrupted, 130},
+}
+
+func exitCode(err error) int {
+	for _, entry := range exitCodes {
+		if errors.Is(err, entry.err) {
+			return entry.code
+		}
+	}
+	return 1
+}
+
+// audited records every run of a mutating command in the audit log, whether
+// it succeeded or not. Actions fill in the user and app they act as and on.
+func audited(action func(c *cli.Context, entry *AuditEntry) error) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		entry := AuditEntry{Command: c.Command.Name, Args: c.Args().Slice()}
+		err := action(c, &entry)
+
+		if entry.User == "" {
+			// Record denied attempts by logged in users, but not runs that
+			// never got far enough to identify anyone.
+			if entry.User, _ = GetCurrentUser(); entry.User == "" {
+				return err
+			}
+		}
+
+		entry.Result = "ok"
+		if err != nil {
+			entry.Result = "error: " + err.Error()
+		}
+		if auditErr := RecordAudit(entry); auditErr != nil {
+			fmt.Fprintln(os.Stderr, "Warning: could not write audit log: "+auditErr.Error())
+		}
+		return err
+	}
+}
+
+func usageError(c *cli.Context, message string) error {
+	fmt.Println(message)
+	cli.ShowCommandHelp(c, c.Command.Name)
+	return fmt.Errorf("%s: %w", message, ErrInvalidInput)
+}
+
+// provisionApp starts provisioning a new app with the provider and server
+// options given by the provision command's flags.
+func provisionApp(c *cli.Context, app string) error {
+	if c.String("provider") == "existing" && c.String("ip") == "" {
+		return usageError(c, "The existing provider needs the IP of the server, pass it with --ip.")
+	}
+	provider, err := NewCloudProvider(c.String("provider"), c.String("ip"))
+	if err != nil {
+		return err
+	}
+	options, err := ValidateServerOptions(provider, ServerOptions{
+		Size:       c.String("size"),
+		Region:     c.String("region"),
+		Image:      c.String("image"),
+		Tags:       c.StringSlice("tag"),
+		VPC:        c.String("vpc"),
+		IPv6:       c.Bool("ipv6"),
+		Monitoring: c.Bool("monitoring"),
+		Backups:    c.Bool("backups"),
+	})
+	if err != nil {
+		return err
+	}
+	return ProvisionServerForApp(app, provider, c.String("ip"), options, c.Bool("keep-on-failure"))
+}
+
+func requireAdmin() (string, error) {
+	username, err := GetCurrentUser()
+	if err != nil {
+		return "", err
+	}
+	user, err := GetUser(username)
+	if err != nil {
+		return "", err
+	}
+
+	if !user.IsAdmin {
+		return "", fmt.Errorf("you do not have admin access: %w", ErrAccessDenied)
+	}
+	return username, nil
+}
+
+func requirePermission(app string, permission Permission) (string, error) {
+	username, err := GetCurrentUser()
+	if err != nil {
+		return "", err
+	}
+	hasPermission, err := HasPermission(username, app, permission)
+	if err != nil {
+		return "", err
+	}
+
+	if !hasPermission {
+		return "", fmt.Errorf("you don't have %s access to %s: %w", permission, app, ErrAccessDenied)
+	}
+	return username, nil
+}
+
+// notify sends a notification without failing a command that already
+// succeeded.
+func notify(n Notification) {
+	if err := Notify(n); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: "+err.Error())
 	}
 }
@@ -7,54 +7,85 @@ import (
 	"strings"
 	"syscall"
 
-	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
-func promptUsername() string {
+func promptUsername() (string, error) {
 	fmt.Print("Username: ")
 
 	scanner := bufio.NewScanner(os.Stdin)
 	scanner.Scan()
 	username := scanner.Text()
 	if username == "" {
-		fmt.Println("\nYour username cannot be empty. Try again.")
-		os.Exit(1)
+		return "", fmt.Errorf("your username cannot be empty: %w", ErrInvalidInput)
 	}
-	return username
+	return username, nil
 }
 
-func promptPassword(prompt string) []byte {
+func promptPassword(prompt string) ([]byte, error) {
 	fmt.Print(prompt)
-	bytePassword, _ := terminal.ReadPassword(int(syscall.Stdin))
+	bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return nil, err
+	}
 
 	if string(bytePassword) == "" {
-		fmt.Println("\nYour password cannot be empty. Try again.")
-		os.Exit(1)
+		return nil, fmt.Errorf("your password cannot be empty: %w", ErrInvalidInput)
 	}
-	return bytePassword
+	return bytePassword, nil
 }
 
-func Signup() (string, string) {
-	username := promptUsername()
+func Signup() (string, string, error) {
+	username, err := promptUsername()
+	if err != nil {
+		return "", "", err
+	}
+
+	username = strings.TrimSpace(username)
+	hash, err := PromptNewPassword(username, "Password: ")
+	if err != nil {
+		return "", "", err
+	}
+
+	return username, hash, nil
+}
 
-	bytePassword := promptPassword("Password: ")
-	bytePassword2 := promptPassword("\nPassword again: ")
+// PromptNewPassword asks for a password twice, checks it against the password
+// policy and returns its hash.
+func PromptNewPassword(username string, prompt string) (string, error) {
+	bytePassword, err := promptPassword(prompt)
+	if err != nil {
+		return "", err
+	}
+	if err := checkPasswordPolicy(username, bytePassword); err != nil {
+		return "", err
+	}
+	bytePassword2, err := promptPassword("\nPassword again: ")
+	if err != nil {
+		return "", err
+	}
 
 	if string(bytePassword) != string(bytePassword2) {
-		fmt.Println("\nYou entered two different passwords. Try again.")
-		os.Exit(1)
+		return "", fmt.Errorf("you entered two different passwords: %w", ErrInvalidInput)
 	}
 
-	hash, _ := bcrypt.GenerateFromPassword(bytePassword, bcrypt.MinCost)
+	return hashPassword(bytePassword)
+}
 
-	return strings.TrimSpace(username), string(hash)
+func PromptCurrentPassword() ([]byte, error) {
+	return promptPassword("Current password: ")
 }
 
-func Login() (string, []byte) {
-	username := promptUsername()
+func Login() (string, []byte, error) {
+	username, err := promptUsername()
+	if err != nil {
+		return "", nil, err
+	}
 
-	bytePassword := promptPassword("Password: ")
+	bytePassword, err := promptPassword("Password: ")
+	if err != nil {
+		return "", nil, err
+	}
 
-	return strings.TrimSpace(username), bytePassword
+	return strings.TrimSpace(username), bytePassword, nil
 }
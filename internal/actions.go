@@ -1,261 +1,456 @@
 package internal
 
 import (
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
-
-	"golang.org/x/crypto/bcrypt"
+	"time"
 )
 
-func downloadPemKey(app string) {
-	file := getFile(app + "/server.pem")
-	if file == nil {
-		fmt.Printf("error occurred pem key for %s\n", app)
-		return
+func GetAppConfiguration(app string) error {
+	files, err := getStore().ListDir(app + "/docker-compose")
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("no config found for %s: %w", app, ErrAppNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("error occurred fetching config for %s: %w", app, err)
+	}
+
+	currDir, _ := os.Getwd()
+	if err := os.MkdirAll(filepath.Join(currDir, "config", app), os.ModePerm); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := downloadFile(file, filepath.Join(currDir, "config", app)); err != nil {
+			return err
+		}
 	}
 
-	dir, _ := os.UserHomeDir()
-	downloadDir := filepath.Join(dir, ".send", app)
-	os.Mkdir(downloadDir, os.ModePerm)
+	return nil
+}
 
-	downloadFile(file, downloadDir)
-	os.Chmod(filepath.Join(downloadDir, "server.pem"), 0600)
+type configPush struct {
+	names   []string
+	changes []FileChange
+	uploads map[string][]byte
+	message string
 }
 
-func GetAppConfiguration(app string) (success bool) {
-	jsonRes := getDirectory(app + "/docker-compose")
-	if jsonRes == nil {
-		fmt.Printf("error occurred fetching config for %s\n", app)
-		return false
+// planPush works out which of the files at paths change the app's
+// docker-compose directory and how to describe the change.
+func planPush(username string, app string, paths []string) (*configPush, error) {
+	files, err := readPushFiles(paths)
+	if err != nil {
+		return nil, err
 	}
 
-	currDir, _ := os.Getwd()
-	os.MkdirAll(filepath.Join(currDir, "config", app), os.ModePerm)
+	current := map[string]string{}
+	listing, err := getStore().ListDir(app + "/docker-compose")
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	for _, file := range listing {
+		current[file.Name] = file.SHA
+	}
 
-	for _, file := range jsonRes {
-		if !downloadFile(file, filepath.Join(currDir, "config", app)) {
-			return false
+	push := &configPush{uploads: map[string][]byte{}}
+	var added, updated []string
+	for name, data := range files {
+		push.names = append(push.names, name)
+		push.uploads["docker-compose/"+name] = data
+
+		// Updates are made against the version listed here, so a push
+		// that lands in between is a conflict rather than overwritten
+		change := FileChange{Path: app + "/docker-compose/" + name, Content: data}
+		if sha, ok := current[name]; !ok {
+			added = append(added, name)
+		} else if sha != blobSHA(data) {
+			updated = append(updated, name)
+			change.SHA = sha
+		} else {
+			continue
 		}
+		push.changes = append(push.changes, change)
 	}
+	sort.Strings(push.names)
+	sort.Strings(added)
+	sort.Strings(updated)
 
-	return true
+	var parts []string
+	if len(added) > 0 {
+		parts = append(parts, "added "+strings.Join(added, ", "))
+	}
+	if len(updated) > 0 {
+		parts = append(parts, "updated "+strings.Join(updated, ", "))
+	}
+	push.message = fmt.Sprintf("%s %s for %s", username, strings.Join(parts, " and "), app)
+	return push, nil
 }
 
-func PushAppConfiguration(username string, app string, path string) {
-	fileName := filepath.Base(path)
-	gitPath := app + "/docker-compose/" + fileName
-
-	data, err := ioutil.ReadFile(path)
+// PushAppConfiguration writes the files at paths, or the files directly in
+// any directory among them, to the app's docker-compose directory as a single
+// commit and copies them to the app's server. It returns the names of the
+// pushed files.
+func PushAppConfiguration(username string, app string, paths []string) ([]string, error) {
+	push, err := planPush(username, app, paths)
 	if err != nil {
-		fmt.Println(err.Error())
-		os.Exit(1)
-	}
-
-	jsonRes := getFile(gitPath)
-	var requestBody fileRequest
-	if jsonRes != nil {
-		requestBody = fileRequest{
-			fmt.Sprintf("%s updated %s for %s", username, fileName, app),
-			base64.StdEncoding.Strict().EncodeToString(data),
-			"master",
-			jsonRes["sha"].(string),
-		}
-	} else {
-		requestBody = fileRequest{
-			fmt.Sprintf("%s added %s for %s", username, fileName, app),
-			base64.StdEncoding.Strict().EncodeToString(data),
-			"master",
-			"",
+		return nil, err
+	}
+
+	// Files that are already up to date in the repo are still copied, in
+	// case the server has drifted.
+	if len(push.changes) > 0 {
+		if _, err := getStore().Commit(push.message, push.changes); err != nil {
+			return nil, err
 		}
 	}
 
-	body, _ := json.Marshal(requestBody)
+	client, err := connectToApp(app)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	if err := client.Upload(push.uploads); err != nil {
+		return nil, fmt.Errorf("error adding files onto %s: %w", app, err)
+	}
+	return push.names, nil
+}
+
+// ProposeAppConfiguration opens a pull request with the changes a push of
+// the files at paths would make, to be merged and copied to the server by an
+// admin with ApprovePullRequest.
+func ProposeAppConfiguration(username string, app string, paths []string) (*PullRequest, error) {
+	push, err := planPush(username, app, paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(push.changes) == 0 {
+		return nil, fmt.Errorf("nothing to review, %s already up to date for %s: %w", strings.Join(push.names, ", "), app, ErrInvalidInput)
+	}
+
+	branch := fmt.Sprintf("send/%s/%s-%d", app, username, time.Now().Unix())
+	body := fmt.Sprintf("Pushed for review by send user %s.\n\nAn admin can merge this and copy the files to the server with `send approve NUMBER`.", username)
+	return getStore().OpenPullRequest(branch, push.message, body, push.changes)
+}
 
-	contentsLink := contentURL + gitPath
-	_, statusCode := performRequest("PUT", contentsLink, body)
+// ApprovePullRequest merges a pull request opened by ProposeAppConfiguration
+// and copies the files it changes to the app's server. It returns the app
+// and the pull request, even if merging failed.
+func ApprovePullRequest(username string, number int) (string, *PullRequest, error) {
+	pr, err := getStore().GetPullRequest(number)
+	if err != nil {
+		return "", nil, err
+	}
+	if pr.State != "open" {
+		return "", pr, fmt.Errorf("pull request #%d is %s: %w", number, pr.State, ErrConflict)
+	}
 
-	if statusCode == 200 || statusCode == 201 {
-		downloadPemKey(app)
-		homeDir, _ := os.UserHomeDir()
-		pemPath := filepath.Join(homeDir, ".send", app, "server.pem")
+	// Only pull requests that stay within one app's compose files can be
+	// applied to a server.
+	app := ""
+	for _, change := range pr.Changes {
+		parts := strings.Split(change.Path, "/")
+		if len(parts) != 3 || parts[1] != "docker-compose" || (app != "" && parts[0] != app) {
+			return app, pr, fmt.Errorf("pull request #%d changes %s, not just one app's docker-compose files: %w", number, change.Path, ErrInvalidInput)
+		}
+		app = parts[0]
+	}
+	if app == "" {
+		return "", pr, fmt.Errorf("pull request #%d changes no files: %w", number, ErrInvalidInput)
+	}
 
-		cmd := exec.Command(
-			"scp",
-			"-i",
-			pemPath,
-			path,
-			fmt.Sprintf("appdev@%s:docker-compose", getHost(app)),
-		)
+	message := fmt.Sprintf("%s approved #%d: %s", username, number, pr.Title)
+	mergeSHA, err := getStore().MergePullRequest(number, pr.HeadSHA, message)
+	if err != nil {
+		return app, pr, err
+	}
 
-		_, err := cmd.Output()
+	client, err := connectToApp(app)
+	if err != nil {
+		return app, pr, err
+	}
+	defer client.Close()
+
+	uploads := map[string][]byte{}
+	for _, change := range pr.Changes {
+		remotePath := "docker-compose/" + path.Base(change.Path)
+		if change.Delete {
+			if err := client.Remove(remotePath); err != nil {
+				return app, pr, err
+			}
+			continue
+		}
+		file, err := getStore().ReadFileAt(change.Path, mergeSHA)
 		if err != nil {
-			fmt.Printf("Error adding file %s onto %s: %s \n", path, app, err)
-			os.Exit(1)
+			return app, pr, err
 		}
-
-		os.Remove(pemPath)
+		uploads[remotePath] = file.Content
 	}
+	if err := client.Upload(uploads); err != nil {
+		return app, pr, fmt.Errorf("error adding files onto %s: %w", app, err)
+	}
+	return app, pr, nil
 }
 
-func RegisterUser(username string, password string) {
-	if getFile("users/"+username+".json") != nil {
-		fmt.Println("\nUser with provided username already exists.")
-		os.Exit(1)
+// readPushFiles reads the files to push, keyed by name. Directories
+// contribute the regular files directly inside them, except hidden ones.
+func readPushFiles(paths []string) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	add := func(filePath string) error {
+		name := filepath.Base(filePath)
+		if _, ok := files[name]; ok {
+			return fmt.Errorf("more than one file named %s: %w", name, ErrInvalidInput)
+		}
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", err, ErrInvalidInput)
+		}
+		files[name] = data
+		return nil
 	}
 
-	contentsLink := contentURL + "users/" + username + ".json"
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", err, ErrInvalidInput)
+		}
+		if !info.IsDir() {
+			if err := add(p); err != nil {
+				return nil, err
+			}
+			continue
+		}
 
-	newUser := user{
-		username,
-		password,
-		[]string{},
-		false,
+		entries, err := ioutil.ReadDir(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", err, ErrInvalidInput)
+		}
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				if err := add(filepath.Join(p, entry.Name())); err != nil {
+					return nil, err
+				}
+			}
+		}
 	}
-	userJson, _ := json.MarshalIndent(newUser, "", "\t")
 
-	requestBody := fileRequest{
-		"Register user " + username,
-		base64.StdEncoding.Strict().EncodeToString(userJson),
-		"master",
-		"",
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files to push in %s: %w", strings.Join(paths, ", "), ErrInvalidInput)
 	}
+	return files, nil
+}
 
-	b, _ := json.Marshal(requestBody)
+func RegisterUser(username string, password string) error {
+	newUser := user{
+		Username:       username,
+		HashedPassword: password,
+		Roles:          map[string]string{},
+		SchemaVersion:  userSchemaVersion,
+	}
+	userJson, _ := json.MarshalIndent(newUser, "", "\t")
 
-	performRequest("PUT", contentsLink, b)
+	_, err := getStore().WriteFile("users/"+username+".json", userJson, "", "Register user "+username)
+	if errors.Is(err, ErrConflict) {
+		return fmt.Errorf("user with username %s already exists: %w", username, ErrConflict)
+	}
+	return err
 }
 
-func getUserAndSHA(username string) (user, string) {
-	fileRes := getFile("users/" + username + ".json")
+func getUserAndSHA(username string) (user, string, error) {
+	file, err := getStore().ReadFile("users/" + username + ".json")
 
-	if fileRes == nil {
-		fmt.Println("User does not exist.")
-		os.Exit(1)
+	if errors.Is(err, ErrNotFound) {
+		return user{}, "", fmt.Errorf("%s: %w", username, ErrUserNotFound)
+	}
+	if err != nil {
+		return user{}, "", err
 	}
-
-	fileContents, _ := base64.StdEncoding.Strict().DecodeString(fileRes["content"].(string))
 
 	user := user{}
-	json.Unmarshal(fileContents, &user)
+	if err := json.Unmarshal(file.Content, &user); err != nil {
+		return user, "", fmt.Errorf("error parsing user file for %s: %w", username, err)
+	}
+	migrateUser(&user)
 
-	return user, fileRes["sha"].(string)
+	return user, file.SHA, nil
 }
 
-func GetUser(username string) user {
-	user, _ := getUserAndSHA(username)
-	return user
+func GetUser(username string) (user, error) {
+	user, _, err := getUserAndSHA(username)
+	return user, err
 }
 
-func VerifyUser(username string, password []byte) (user, bool) {
-	user := GetUser(username)
-	err := bcrypt.CompareHashAndPassword([]byte(user.HashedPassword), password)
-
-	return user, err == nil
-}
+func VerifyUser(username string, password []byte) (user, error) {
+	user, err := GetUser(username)
+	if errors.Is(err, ErrUserNotFound) {
+		return user, ErrInvalidCredentials
+	}
+	if err != nil {
+		return user, err
+	}
 
-func AddApp(username string, app string) {
-	user, sha := getUserAndSHA(username)
+	if comparePassword(user.HashedPassword, password) != nil {
+		return user, ErrInvalidCredentials
+	}
 
-	if contains(user.Apps, app) {
-		fmt.Printf("User %s already has access to %s\n", username, app)
-		return
+	if needsRehash(user.HashedPassword) {
+		if rehashed, err := rehashPassword(user, password); err == nil {
+			user = rehashed
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: could not upgrade password hash: %s\n", err)
+		}
 	}
+	return user, nil
+}
 
-	user.Apps = append(user.Apps, app)
-	userJson, _ := json.MarshalIndent(user, "", "\t")
+// errUnchanged lets an updateUser callback skip writing the user file.
+var errUnchanged = errors.New("unchanged")
 
-	requestBody := fileRequest{
-		fmt.Sprintf("Grant app access to %s for %s", app, username),
-		base64.StdEncoding.Strict().EncodeToString(userJson),
-		"master",
-		sha,
-	}
+// updateUser applies update to the latest version of a user file and writes it
+// back, retrying if the file was changed by someone else in between.
+func updateUser(username string, message string, update func(*user) error) error {
+	for attempt := 1; ; attempt++ {
+		user, sha, err := getUserAndSHA(username)
+		if err != nil {
+			return err
+		}
 
-	body, _ := json.Marshal(requestBody)
+		if err := update(&user); err == errUnchanged {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		userJson, _ := json.MarshalIndent(user, "", "\t")
 
-	contentsLink := contentURL + "users/" + username + ".json"
-	performRequest("PUT", contentsLink, body)
+		_, err = getStore().WriteFile("users/"+username+".json", userJson, sha, message)
+		if !errors.Is(err, ErrConflict) || attempt == 3 {
+			return err
+		}
+	}
 }
 
-func HasAccessTo(username string, app string) bool {
-	user := GetUser(username)
+// RemoveApps revokes a user's access to the given apps, or to every app if
+// apps is nil. Grants to apps that no longer exist are removed as well.
+func RemoveApps(username string, apps []string) (removed []string, err error) {
+	existing, err := GetApps()
+	if err != nil {
+		return nil, err
+	}
 
-	return user.IsAdmin || contains(user.Apps, app)
-}
+	message := fmt.Sprintf("Revoke app access to %s for %s", strings.Join(apps, ", "), username)
+	if apps == nil {
+		message = fmt.Sprintf("Revoke all app access for %s", username)
+	}
 
-func ExecCmd(app string, command string) string {
-	downloadPemKey(app)
-	homeDir, _ := os.UserHomeDir()
-	pemPath := filepath.Join(homeDir, ".send", app, "server.pem")
+	err = updateUser(username, message, func(user *user) error {
+		removed = nil
+		for app := range user.Roles {
+			if apps == nil || contains(apps, app) || !contains(existing, app) {
+				removed = append(removed, app)
+				delete(user.Roles, app)
+			}
+		}
 
-	cmd := exec.Command(
-		"ssh",
-		"-i",
-		pemPath,
-		fmt.Sprintf("appdev@%s", getHost(app)),
-		command,
-	)
+		if len(removed) == 0 {
+			return errUnchanged
+		}
+		sort.Strings(removed)
+		return nil
+	})
+	return removed, err
+}
 
-	output, err := cmd.Output()
+// ExecCmd runs command on the app's manager with the local terminal attached
+// and returns the command's exit status.
+func ExecCmd(app string, command string, tty bool) (int, error) {
+	client, err := connectToApp(app)
 	if err != nil {
-		fmt.Printf("error executing command for %s : %s\n", app, err)
-		os.Exit(1)
+		return 0, err
 	}
+	defer client.Close()
 
-	os.Remove(pemPath)
-
-	return string(output)
+	status, err := client.Stream(command, tty)
+	if err != nil {
+		return status, fmt.Errorf("error executing command for %s: %w", app, err)
+	}
+	return status, nil
 }
 
-func getHost(app string) string {
-	fileRes := getFile(app + "/hosts")
+func getHost(app string) (string, error) {
+	file, err := getStore().ReadFile(app + "/hosts")
 
-	if fileRes == nil {
-		fmt.Println("Could not find specified app or hosts file")
-		os.Exit(1)
+	if errors.Is(err, ErrNotFound) {
+		return "", fmt.Errorf("could not find hosts file for %s: %w", app, ErrAppNotFound)
+	}
+	if err != nil {
+		return "", err
 	}
 
-	fileContents, _ := base64.StdEncoding.Strict().DecodeString(fileRes["content"].(string))
-
-	return strings.TrimSpace(strings.Split(string(fileContents), "\n")[1])
+	lines := strings.Split(string(file.Content), "\n")
+	if len(lines) < 2 {
+		return "", fmt.Errorf("hosts file for %s has no manager host: %w", app, ErrInvalidInput)
+	}
+	return strings.TrimSpace(lines[1]), nil
 }
 
-func commitBundle(app string) {
+func commitBundle(app string) error {
 	homeDir, _ := os.UserHomeDir()
 	dirPath := filepath.Join(homeDir, ".send", app)
 
-	var files []tree
-	filepath.Walk(dirPath, createBlobs(app, &files))
-
-	treeSHA := createTree(files)
-	commitSHA := createCommit(app, treeSHA)
-
-	refBody, _ := json.Marshal(referenceRequest{commitSHA})
-	_, statusCode := performRequest("PATCH", gitURL+"refs/heads/master", refBody)
-	if statusCode != 200 {
-		fmt.Println("error updating master with new commit")
-		os.Exit(1)
+	var changes []FileChange
+	if err := filepath.Walk(dirPath, bundleChanges(app, &changes)); err != nil {
+		return err
 	}
+
+	_, err := getStore().Commit("Add deployment bundle for new app: "+app, changes)
+	return err
 }
 
-func GetApps() []string {
-	rootDir := getDirectory("/")
+func GetApps() ([]string, error) {
+	rootDir, err := getStore().ListDir("")
+	if err != nil {
+		return nil, err
+	}
 	var apps []string
 
 	for _, content := range rootDir {
-		if content["type"].(string) == "dir" {
-			dirName := content["name"].(string)
-			if dirName != "starter" && dirName != "users" {
+		if content.Type == "dir" {
+			dirName := content.Name
+			if dirName != "starter" && dirName != "users" && dirName != auditDir {
 				apps = append(apps, dirName)
 			}
 		}
 	}
 
-	return apps
+	return apps, nil
+}
+
+func bundleChanges(app string, changes *[]FileChange) filepath.WalkFunc {
+	return func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() == provisionJournalFile {
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		*changes = append(*changes, FileChange{
+			Path:    filepath.ToSlash(path[strings.LastIndex(path, app):]),
+			Content: data,
+		})
+		return nil
+	}
 }
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTestStore makes a new bare repository the store of the package for the
+// rest of the test.
+func useTestStore(t *testing.T) *gitRepoStore {
+	t.Helper()
+	repo := newTestRepoStore(t)
+	saved := store
+	SetConfigStore(repo)
+	t.Cleanup(func() { store = saved })
+	return repo
+}
+
+// writeTestFile writes content to name in a new temporary directory and
+// returns its path.
+func writeTestFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "send-push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPlanPushConflictsWithConcurrentPush(t *testing.T) {
+	repo := useTestStore(t)
+	mustCommit(t, repo, "Add web", FileChange{Path: "app/docker-compose/web.yml", Content: []byte("web: 1\n")})
+
+	push, err := planPush("alice", "app", []string{writeTestFile(t, "web.yml", "web: 2\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "alice updated web.yml for app"; push.message != want {
+		t.Errorf("message = %q, want %q", push.message, want)
+	}
+
+	// Someone else pushes after the plan was made
+	mustCommit(t, repo, "Bob updates web", FileChange{Path: "app/docker-compose/web.yml", Content: []byte("web: 3\n")})
+
+	if _, err := getStore().Commit(push.message, push.changes); !errors.Is(err, ErrConflict) {
+		t.Errorf("Commit of a stale push = %v, want ErrConflict", err)
+	}
+	if got := readContent(t, repo, "app/docker-compose/web.yml"); got != "web: 3\n" {
+		t.Errorf("web.yml = %q, the concurrent push was overwritten", got)
+	}
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const appMetadataFile = "app.json"
+
+// appMetadata holds per-app settings in <app>/app.json in the devops repo.
+type appMetadata struct {
+	RequireReview bool `json:"require_review"`
+	// Where the app's server was provisioned, so it can be found again
+	Provider string         `json:"provider,omitempty"`
+	ServerID string         `json:"server_id,omitempty"`
+	KeyID    string         `json:"key_id,omitempty"`
+	Server   *ServerOptions `json:"server,omitempty"`
+}
+
+// getAppMetadata returns an app's settings along with the blob SHA of the
+// file. Apps without the file have the default settings.
+func getAppMetadata(app string) (appMetadata, string, error) {
+	metadata := appMetadata{}
+	file, err := getStore().ReadFile(app + "/" + appMetadataFile)
+	if errors.Is(err, ErrNotFound) {
+		return metadata, "", nil
+	}
+	if err != nil {
+		return metadata, "", err
+	}
+
+	if err := json.Unmarshal(file.Content, &metadata); err != nil {
+		return metadata, "", fmt.Errorf("error parsing %s/%s: %w", app, appMetadataFile, err)
+	}
+	return metadata, file.SHA, nil
+}
+
+// updateAppMetadata applies update to an app's settings and writes them back,
+// retrying if the file changed concurrently.
+func updateAppMetadata(app string, message string, update func(*appMetadata)) error {
+	if _, err := getHost(app); err != nil {
+		return err
+	}
+
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		var metadata appMetadata
+		var sha string
+		if metadata, sha, err = getAppMetadata(app); err != nil {
+			return err
+		}
+		update(&metadata)
+
+		content, _ := json.MarshalIndent(metadata, "", "\t")
+		if _, err = getStore().WriteFile(app+"/"+appMetadataFile, content, sha, message); !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// SetRequireReview sets whether pushes to an app by users other than admins
+// must go through a pull request.
+func SetRequireReview(username string, app string, required bool) error {
+	message := fmt.Sprintf("%s disabled required review for %s", username, app)
+	if required {
+		message = fmt.Sprintf("%s enabled required review for %s", username, app)
+	}
+	return updateAppMetadata(app, message, func(metadata *appMetadata) {
+		metadata.RequireReview = required
+	})
+}
+
+// ReviewRequired reports whether a push by username to app has to be a pull
+// request. Admins can always push directly.
+func ReviewRequired(username string, app string) (bool, error) {
+	user, err := GetUser(username)
+	if err != nil {
+		return false, err
+	}
+	if user.IsAdmin {
+		return false, nil
+	}
+
+	metadata, _, err := getAppMetadata(app)
+	if err != nil {
+		return false, err
+	}
+	return metadata.RequireReview, nil
+}
+
+// appFileDeletions returns the changes that delete every file under dir in
+// the devops repo.
+func appFileDeletions(dir string) ([]FileChange, error) {
+	entries, err := getStore().ListDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []FileChange
+	for _, entry := range entries {
+		if entry.Type == "dir" {
+			nested, err := appFileDeletions(entry.Path)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, nested...)
+		} else {
+			changes = append(changes, FileChange{Path: entry.Path, Delete: true, SHA: entry.SHA})
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const auditDir = "audit"
+
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Command string    `json:"command"`
+	App     string    `json:"app,omitempty"`
+	Args    []string  `json:"args,omitempty"`
+	Result  string    `json:"result"`
+	Commit  string    `json:"commit,omitempty"`
+}
+
+type AuditFilter struct {
+	App   string
+	User  string
+	Since time.Time
+}
+
+// RecordAudit appends entry to the audit log for the day it happened. The log
+// lives in the config store as one JSON object per line in audit/<date>.jsonl.
+// If entry has no commit, the last commit made by this process is used.
+func RecordAudit(entry AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Time = entry.Time.UTC()
+	if entry.Commit == "" && store != nil {
+		entry.Commit = store.lastCommit
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	path := auditDir + "/" + entry.Time.Format("2006-01-02") + ".jsonl"
+	message := fmt.Sprintf("Audit %s %s by %s", entry.Command, entry.App, entry.User)
+
+	for attempt := 1; ; attempt++ {
+		var content []byte
+		sha := ""
+		file, err := getStore().ReadFile(path)
+		if err == nil {
+			content = file.Content
+			sha = file.SHA
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		content = append(content, line...)
+		content = append(content, '\n')
+		_, err = getStore().WriteFile(path, content, sha, strings.Join(strings.Fields(message), " "))
+		if !errors.Is(err, ErrConflict) || attempt == 3 {
+			return err
+		}
+	}
+}
+
+// GetAuditLog returns the entries matching filter, oldest first.
+func GetAuditLog(filter AuditFilter) ([]AuditEntry, error) {
+	files, err := getStore().ListDir(auditDir)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	since := filter.Since.UTC().Format("2006-01-02")
+	var entries []AuditEntry
+	for _, file := range files {
+		if file.Type != "file" || !strings.HasSuffix(file.Name, ".jsonl") {
+			continue
+		}
+		if !filter.Since.IsZero() && strings.TrimSuffix(file.Name, ".jsonl") < since {
+			continue
+		}
+
+		fullFile, err := getStore().ReadFile(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range bytes.Split(fullFile.Content, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var entry AuditEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				return nil, fmt.Errorf("error parsing %s: %w", file.Path, err)
+			}
+
+			if (filter.App != "" && entry.App != filter.App) || (filter.User != "" && entry.User != filter.User) {
+				continue
+			}
+			if entry.Time.Before(filter.Since) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
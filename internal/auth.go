@@ -1,12 +1,11 @@
 package internal
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -18,19 +17,23 @@ import (
 )
 
 type credentials struct {
-	Token     string `json:"token"`
-	ExpiresAt int64  `json:"expires_at"`
+	Token          string `json:"token"`
+	ExpiresAt      int64  `json:"expires_at"`
+	APIURL         string `json:"api_url"`
+	Repository     string `json:"repository"`
+	InstallationID int64  `json:"installation_id"`
 }
 
-func generateJWTToken() string {
+func generateJWTToken() (string, error) {
 	signBytes, err := ioutil.ReadFile(os.Getenv("GIT_PEM_KEY_PATH"))
-
 	if err != nil {
-		fmt.Println(err.Error())
-		os.Exit(1)
+		return "", fmt.Errorf("error reading GitHub App key: %w", err)
 	}
 
 	signKey, err := jwt.ParseRSAPrivateKeyFromPEM(signBytes)
+	if err != nil {
+		return "", fmt.Errorf("error parsing GitHub App key: %w", err)
+	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
 		"iat": time.Now().Unix(),
@@ -38,26 +41,69 @@ func generateJWTToken() string {
 		"iss": os.Getenv("GIT_APP_ID"),
 	})
 
-	tokenString, err := token.SignedString(signKey)
-	return tokenString
+	return token.SignedString(signKey)
 }
 
-func requestInstallationToken() string {
+func performAppRequest(method string, url string) (responseBody []byte, statusCode int, err error) {
 	client := &http.Client{}
-	var bodyBuffer io.Reader = nil
 
-	req, _ := http.NewRequest("POST", "https://github.coecis.cornell.edu/api/v3/app/installations/1/access_tokens", bodyBuffer)
-	req.Header.Set("Authorization", "Bearer "+generateJWTToken())
+	jwtToken, err := generateJWTToken()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Set("Authorization", "Bearer "+jwtToken)
 	req.Header.Set("Accept", "application/vnd.github.machine-man-preview+json")
-	resp, _ := client.Do(req)
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s %s: %s: %w", method, url, err, ErrStoreFailure)
+	}
 
 	defer resp.Body.Close()
 	respBody, _ := ioutil.ReadAll(resp.Body)
 
-	token := gjson.GetBytes(respBody, "token").String()
+	return respBody, resp.StatusCode, nil
+}
+
+// getInstallationID returns the configured installation ID, or looks up the
+// installation of the app on the configured repository when none is set.
+func getInstallationID() (int64, error) {
+	if config.InstallationID != 0 {
+		return config.InstallationID, nil
+	}
+
+	res, statusCode, err := performAppRequest("GET", config.APIURL+"/repos/"+config.Repository+"/installation")
+	if err != nil {
+		return 0, err
+	}
+	if statusCode != 200 {
+		return 0, fmt.Errorf("error finding the GitHub App installation for %s: status %d: %w", config.Repository, statusCode, ErrStoreFailure)
+	}
+
+	config.InstallationID = gjson.GetBytes(res, "id").Int()
+	return config.InstallationID, nil
+}
+
+func requestInstallationToken() (string, error) {
+	installationID, err := getInstallationID()
+	if err != nil {
+		return "", err
+	}
+
+	res, statusCode, err := performAppRequest("POST", fmt.Sprintf("%s/app/installations/%d/access_tokens", config.APIURL, installationID))
+	if err != nil {
+		return "", err
+	}
+	if statusCode != 201 {
+		return "", fmt.Errorf("error requesting an access token for installation %d: status %d: %w", installationID, statusCode, ErrStoreFailure)
+	}
+
+	token := gjson.GetBytes(res, "token").String()
 
-	writeCredentials(token, time.Now().Add(time.Hour).Unix())
-	return token
+	writeCredentials(credentials{token, time.Now().Add(time.Hour).Unix(), config.APIURL, config.Repository, installationID})
+	return token, nil
 }
 
 func getCredentialsPath() string {
@@ -65,17 +111,15 @@ func getCredentialsPath() string {
 	return path.Join(dir, ".send")
 }
 
-func writeCredentials(token string, expires_at int64) {
+func writeCredentials(credentials credentials) {
 	os.Mkdir(getCredentialsPath(), 0755)
 
-	credentials := credentials{token, expires_at}
-
 	file, _ := json.MarshalIndent(credentials, "", "\t")
 
 	_ = ioutil.WriteFile(path.Join(getCredentialsPath(), "credentials.json"), file, 0644)
 }
 
-func getInstallationToken() string {
+func getInstallationToken() (string, error) {
 	file, err := ioutil.ReadFile(path.Join(getCredentialsPath(), "credentials.json"))
 
 	if err != nil {
@@ -85,49 +129,118 @@ func getInstallationToken() string {
 	credentials := credentials{}
 	_ = json.Unmarshal([]byte(file), &credentials)
 
-	if credentials.ExpiresAt < time.Now().Unix() {
+	if credentials.ExpiresAt < time.Now().Unix() || credentials.APIURL != config.APIURL || credentials.Repository != config.Repository {
+		return requestInstallationToken()
+	}
+	if config.InstallationID != 0 && credentials.InstallationID != config.InstallationID {
 		return requestInstallationToken()
 	}
 
-	return credentials.Token
+	return credentials.Token, nil
 }
 
-func WriteUser(username string) {
-	// Encrypt username
-	signBytes := []byte(os.Getenv("ENCRYPTION_KEY"))
-	c, _ := aes.NewCipher(signBytes)
-	gcm, _ := cipher.NewGCM(c)
-	nonce := make([]byte, gcm.NonceSize())
-	io.ReadFull(rand.Reader, nonce)
+type Session struct {
+	Username  string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
 
-	encryptedUsername := gcm.Seal(nonce, nonce, []byte(username), nil)
-	ioutil.WriteFile(path.Join(getCredentialsPath(), "user"), encryptedUsername, 0644)
+func getSessionPath() string {
+	return path.Join(getCredentialsPath(), "session")
 }
 
-func GetCurrentUser() string {
-	file, err := ioutil.ReadFile(path.Join(getCredentialsPath(), "user"))
+// sessionKey derives the key a user's sessions are signed with from their
+// password hash, so changing the password invalidates every session. Reading
+// the hash requires access to the devops repo, which already allows editing
+// the user file directly.
+func sessionKey(user user) []byte {
+	mac := hmac.New(sha256.New, []byte(user.HashedPassword))
+	mac.Write([]byte("send session"))
+	return mac.Sum(nil)
+}
+
+func WriteUser(user user, ttl time.Duration) (*Session, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("session ttl must be positive: %w", ErrInvalidInput)
+	}
 
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		Subject:   user.Username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	})
+	tokenString, err := token.SignedString(sessionKey(user))
 	if err != nil {
-		return ""
+		return nil, err
 	}
 
-	// Decrypt username
-	signBytes := []byte(os.Getenv("ENCRYPTION_KEY"))
-	c, _ := aes.NewCipher(signBytes)
-	gcm, _ := cipher.NewGCM(c)
-	nonceSize := gcm.NonceSize()
-	nonce, file := file[:nonceSize], file[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, file, nil)
+	os.Remove(path.Join(getCredentialsPath(), "user"))
+	os.Mkdir(getCredentialsPath(), 0755)
+	if err := ioutil.WriteFile(getSessionPath(), []byte(tokenString), 0600); err != nil {
+		return nil, err
+	}
+	return &Session{user.Username, time.Unix(now.Unix(), 0), time.Unix(now.Add(ttl).Unix(), 0)}, nil
+}
 
-	return string(plaintext)
+// GetSession verifies the stored session against the user's current password
+// hash and returns it if it is still valid.
+func GetSession() (*Session, error) {
+	file, err := ioutil.ReadFile(getSessionPath())
+	if err != nil {
+		return nil, ErrLoginRequired
+	}
+
+	claims := jwt.StandardClaims{}
+	_, err = jwt.ParseWithClaims(string(file), &claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+
+		user, err := GetUser(token.Claims.(*jwt.StandardClaims).Subject)
+		if err != nil {
+			return nil, err
+		}
+		if user.HashedPassword == "" {
+			return nil, fmt.Errorf("user %s has no password", user.Username)
+		}
+		return sessionKey(user), nil
+	})
+
+	if validationErr, ok := err.(*jwt.ValidationError); ok {
+		if validationErr.Errors&jwt.ValidationErrorExpired != 0 {
+			return nil, fmt.Errorf("session expired: %w", ErrLoginRequired)
+		}
+		if errors.Is(validationErr.Inner, ErrStoreFailure) {
+			return nil, validationErr.Inner
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("session is invalid: %w", ErrLoginRequired)
+	}
+
+	return &Session{claims.Subject, time.Unix(claims.IssuedAt, 0), time.Unix(claims.ExpiresAt, 0)}, nil
+}
+
+func GetCurrentUser() (string, error) {
+	session, err := GetSession()
+	if err != nil {
+		return "", err
+	}
+	return session.Username, nil
 }
 
-func ClearCurrentUser() {
-	err := os.Remove(path.Join(getCredentialsPath(), "user"))
+func ClearCurrentUser() error {
+	os.Remove(path.Join(getCredentialsPath(), "user"))
+	err := os.Remove(getSessionPath())
 
 	if os.IsNotExist(err) {
 		fmt.Println("No user is currently logged in")
-	} else {
-		fmt.Println("Successfully logged out")
+		return nil
+	} else if err != nil {
+		return err
 	}
+
+	fmt.Println("Successfully logged out")
+	return nil
 }
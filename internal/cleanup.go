@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"os"
+	"sync"
+)
+
+type cleanup struct {
+	id    int
+	f     func()
+	stops bool
+}
+
+var (
+	cleanupMutex sync.Mutex
+	cleanups     []cleanup
+	nextCleanup  int
+	forwarder    func(os.Signal)
+)
+
+// onCleanup registers f to be run by RunCleanups until the returned function
+// is called, which removes it again.
+func onCleanup(f func()) (remove func()) {
+	return addCleanup(f, false)
+}
+
+// onInterrupt registers f like onCleanup, for a command that stops by itself
+// once f returns. The CLI then lets the command finish instead of exiting.
+func onInterrupt(f func()) (remove func()) {
+	return addCleanup(f, true)
+}
+
+func addCleanup(f func(), stops bool) (remove func()) {
+	cleanupMutex.Lock()
+	defer cleanupMutex.Unlock()
+
+	nextCleanup++
+	id := nextCleanup
+	cleanups = append(cleanups, cleanup{id, f, stops})
+
+	return func() {
+		cleanupMutex.Lock()
+		defer cleanupMutex.Unlock()
+
+		for i, c := range cleanups {
+			if c.id == id {
+				cleanups = append(cleanups[:i], cleanups[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// RunCleanups runs every registered cleanup, most recent first. The CLI calls
+// it when it is interrupted so nothing is left behind. It reports whether one
+// of them stopped the running command, which then returns by itself, so the
+// CLI should not exit before it has.
+func RunCleanups() (stopped bool) {
+	cleanupMutex.Lock()
+	pending := cleanups
+	cleanups = nil
+	cleanupMutex.Unlock()
+
+	for i := len(pending) - 1; i >= 0; i-- {
+		pending[i].f()
+		stopped = stopped || pending[i].stops
+	}
+	return stopped
+}
+
+// forwardSignals hands the next interrupt to f instead of aborting the CLI
+// until the returned function is called. Only one interrupt is forwarded, so
+// a second one still aborts if the server ignores the first.
+func forwardSignals(f func(os.Signal)) (stop func()) {
+	cleanupMutex.Lock()
+	defer cleanupMutex.Unlock()
+
+	forwarder = f
+	return func() {
+		cleanupMutex.Lock()
+		defer cleanupMutex.Unlock()
+		forwarder = nil
+	}
+}
+
+// ForwardSignal passes sig on to a running remote command and reports whether
+// there was one. If not, the CLI should run the cleanups and exit.
+func ForwardSignal(sig os.Signal) bool {
+	cleanupMutex.Lock()
+	f := forwarder
+	forwarder = nil
+	cleanupMutex.Unlock()
+
+	if f == nil {
+		return false
+	}
+	f(sig)
+	return true
+}
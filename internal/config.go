@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Config struct {
+	APIURL            string `json:"api_url"`
+	Repository        string `json:"repository"`
+	Branch            string `json:"branch"`
+	InstallationID    int64  `json:"installation_id"`
+	StorePath         string `json:"store_path"`
+	PasswordHash      string `json:"password_hash"`
+	BcryptCost        int    `json:"bcrypt_cost"`
+	MinPasswordLength int    `json:"min_password_length"`
+}
+
+var config = Config{
+	APIURL:            "https://github.coecis.cornell.edu/api/v3",
+	Repository:        "cuappdev/send-devops",
+	Branch:            "master",
+	StorePath:         os.Getenv("SEND_STORE_PATH"),
+	PasswordHash:      "bcrypt",
+	BcryptCost:        12,
+	MinPasswordLength: 10,
+}
+
+func GetConfigPath() string {
+	return path.Join(getCredentialsPath(), "config.json")
+}
+
+// LoadConfig returns the default configuration overridden by any values set
+// in the JSON file at configPath. A missing file is not an error.
+func LoadConfig(configPath string) (Config, error) {
+	loaded := config
+
+	file, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return loaded, nil
+	}
+	if err != nil {
+		return loaded, err
+	}
+
+	if err := json.Unmarshal(file, &loaded); err != nil {
+		return loaded, fmt.Errorf("error parsing %s: %w", configPath, err)
+	}
+	if loaded.PasswordHash != "bcrypt" && loaded.PasswordHash != "argon2id" {
+		return loaded, fmt.Errorf("%s: password_hash must be bcrypt or argon2id", configPath)
+	}
+	if loaded.BcryptCost < bcrypt.MinCost || loaded.BcryptCost > bcrypt.MaxCost {
+		return loaded, fmt.Errorf("%s: bcrypt_cost must be between %d and %d", configPath, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return loaded, nil
+}
+
+func Configure(c Config) {
+	config = c
+	store = nil
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DestroyApp decommissions app after the user types its name to confirm: it
+// destroys the app's server, deletes its SSH key from the provider, and in
+// one commit removes the app's directory from the devops repo and every
+// user's access to it.
+func DestroyApp(app string) error {
+	host, err := getHost(app)
+	if err != nil {
+		return err
+	}
+	metadata, _, err := getAppMetadata(app)
+	if err != nil {
+		return err
+	}
+
+	// What is removed from the repo is only shown here, the changes are
+	// built again right before they are committed
+	changes, users, err := appRemovalChanges(app)
+	if err != nil {
+		return err
+	}
+
+	var provider CloudProvider
+	if metadata.Provider == "" {
+		fmt.Printf("No provider is recorded for %s, its server at %s and SSH key have to be removed by hand.\n", app, host)
+	} else if provider, err = NewCloudProvider(metadata.Provider, host); err != nil {
+		return err
+	} else {
+		fmt.Printf("This destroys server %s on %s and deletes the app's SSH key there.\n", metadata.ServerID, provider.Name())
+	}
+	fmt.Printf("It removes %d files of %s from the devops repo", len(changes)-len(users), app)
+	if len(users) > 0 {
+		fmt.Printf(" and revokes the access of %s", strings.Join(users, ", "))
+	}
+	fmt.Println(".")
+
+	if err := confirmAppName(app); err != nil {
+		return err
+	}
+
+	if provider != nil {
+		if metadata.ServerID != "" {
+			fmt.Printf("Destroying server %s\n", metadata.ServerID)
+			if err := provider.DestroyServer(metadata.ServerID); err != nil {
+				return err
+			}
+		}
+		if metadata.KeyID != "" {
+			fmt.Println("Deleting SSH key")
+			if err := provider.DeleteKey(metadata.KeyID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := removeAppFromRepo(app); err != nil {
+		return err
+	}
+
+	bundleDir := filepath.Join(homeDir, ".send", app)
+	if err := os.RemoveAll(bundleDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not remove %s: %s\n", bundleDir, err)
+	}
+	return nil
+}
+
+// removeAppFromRepo deletes the app's directory and revokes every user's
+// access to it in one commit, retrying if any of the files changed
+// concurrently.
+func removeAppFromRepo(app string) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		var changes []FileChange
+		if changes, _, err = appRemovalChanges(app); err != nil {
+			return err
+		}
+		if _, err = getStore().Commit("Destroy app "+app, changes); !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// appRemovalChanges returns the changes that delete the app's directory and
+// revoke every user's access to it, along with the names of those users.
+// Each change carries the SHA it was made against.
+func appRemovalChanges(app string) ([]FileChange, []string, error) {
+	changes, err := appFileDeletions(app)
+	if err != nil {
+		return nil, nil, err
+	}
+	userChanges, users, err := revokeAppForAllUsers(app)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(changes, userChanges...), users, nil
+}
+
+func confirmAppName(app string) error {
+	fmt.Printf("Type the name of the app to confirm: ")
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Scan()
+	if strings.TrimSpace(scanner.Text()) != app {
+		return fmt.Errorf("confirmation did not match %s, nothing was destroyed: %w", app, ErrInvalidInput)
+	}
+	return nil
+}
+
+// revokeAppForAllUsers returns the changes to the user files that remove
+// every role on app, along with the names of those users.
+func revokeAppForAllUsers(app string) ([]FileChange, []string, error) {
+	files, err := getStore().ListDir("users")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var changes []FileChange
+	var users []string
+	for _, file := range files {
+		if file.Type != "file" || !strings.HasSuffix(file.Name, ".json") {
+			continue
+		}
+		fullFile, err := getStore().ReadFile(file.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		user := user{}
+		if err := json.Unmarshal(fullFile.Content, &user); err != nil {
+			return nil, nil, fmt.Errorf("error parsing %s: %w", file.Path, err)
+		}
+		migrateUser(&user)
+		if _, ok := user.Roles[app]; !ok {
+			continue
+		}
+		delete(user.Roles, app)
+
+		userJson, _ := json.MarshalIndent(user, "", "\t")
+		changes = append(changes, FileChange{Path: file.Path, Content: userJson, SHA: fullFile.SHA})
+		users = append(users, user.Username)
+	}
+	return changes, users, nil
+}
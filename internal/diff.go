@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type DiffOptions struct {
+	// LocalDir holds the local copies, config/<app> if empty.
+	LocalDir   string
+	SkipLocal  bool
+	SkipServer bool
+}
+
+// DiffApp prints unified diffs from the repo version of an app's
+// docker-compose files, or of just fileName if it is set, to the local and
+// server copies. It reports whether any of them differ, and fails with
+// ErrNotFound if fileName is in none of them.
+func DiffApp(app string, fileName string, options DiffOptions) (bool, error) {
+	repo := map[string][]byte{}
+	files, err := getStore().ListDir(app + "/docker-compose")
+	if errors.Is(err, ErrNotFound) {
+		return false, fmt.Errorf("no config found for %s: %w", app, ErrAppNotFound)
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		if file.Type != "file" || (fileName != "" && file.Name != fileName) {
+			continue
+		}
+		full, err := getStore().ReadFile(file.Path)
+		if err != nil {
+			return false, err
+		}
+		repo[file.Name] = full.Content
+	}
+
+	var local map[string][]byte
+	if !options.SkipLocal {
+		localDir := options.LocalDir
+		if localDir == "" {
+			localDir = filepath.Join("config", app)
+		}
+		if local, err = readLocalFiles(localDir, fileName); err != nil {
+			return false, err
+		}
+	}
+
+	var server map[string][]byte
+	if !options.SkipServer {
+		if server, err = readServerFiles(app, fileName); err != nil {
+			return false, err
+		}
+	}
+
+	names := map[string]bool{}
+	for _, copies := range []map[string][]byte{repo, local, server} {
+		for name := range copies {
+			names[name] = true
+		}
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	if fileName != "" && len(sorted) == 0 {
+		return false, fmt.Errorf("%s has no file %s: %w", app, fileName, ErrNotFound)
+	}
+
+	differ := false
+	for _, name := range sorted {
+		for _, other := range []struct {
+			label  string
+			copies map[string][]byte
+		}{{"local", local}, {"server", server}} {
+			if other.copies == nil {
+				continue
+			}
+			diff := unifiedDiff(diffLabel("repo", name, repo), diffLabel(other.label, name, other.copies), repo[name], other.copies[name])
+			if diff != "" {
+				fmt.Print(diff)
+				differ = true
+			}
+		}
+	}
+	return differ, nil
+}
+
+// diffLabel names a copy in a diff header, or /dev/null if there is no copy.
+func diffLabel(label string, name string, copies map[string][]byte) string {
+	if _, ok := copies[name]; !ok {
+		return "/dev/null"
+	}
+	return label + "/" + name
+}
+
+func readLocalFiles(dir string, fileName string) (map[string][]byte, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no local copy in %s, run send pull first: %w", dir, ErrInvalidInput)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") || (fileName != "" && info.Name() != fileName) {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[info.Name()] = content
+	}
+	return files, nil
+}
+
+func readServerFiles(app string, fileName string) (map[string][]byte, error) {
+	client, err := connectToApp(app)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	names, err := client.ListFiles("docker-compose")
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+	for _, name := range names {
+		if fileName != "" && name != fileName {
+			continue
+		}
+		if files[name], err = client.Download("docker-compose/" + name); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+const diffContext = 3
+
+type diffOp struct {
+	kind byte
+	line []byte
+}
+
+// unifiedDiff returns the differences between a and b in unified format, or
+// an empty string if they are equal.
+func unifiedDiff(aName string, bName string, a []byte, b []byte) string {
+	if bytes.Equal(a, b) {
+		return ""
+	}
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	// Line numbers in a and b before each op
+	aPos := make([]int, len(ops)+1)
+	bPos := make([]int, len(ops)+1)
+	for k, op := range ops {
+		aPos[k+1], bPos[k+1] = aPos[k], bPos[k]
+		if op.kind != '+' {
+			aPos[k+1]++
+		}
+		if op.kind != '-' {
+			bPos[k+1]++
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+	for k := 0; k < len(ops); {
+		for k < len(ops) && ops[k].kind == ' ' {
+			k++
+		}
+		if k == len(ops) {
+			break
+		}
+
+		// Changes separated by little enough context share a hunk
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for {
+			for end < len(ops) && ops[end].kind != ' ' {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next < len(ops) && next-end <= 2*diffContext {
+				end = next
+				continue
+			}
+			if end += diffContext; end > len(ops) {
+				end = len(ops)
+			}
+			break
+		}
+
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aPos[start], aPos[end]), hunkRange(bPos[start], bPos[end]))
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.Write(op.line)
+			if !bytes.HasSuffix(op.line, []byte("\n")) {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		k = end
+	}
+	return out.String()
+}
+
+func hunkRange(from int, to int) string {
+	if to-from == 0 {
+		return fmt.Sprintf("%d,0", from)
+	}
+	if to-from == 1 {
+		return fmt.Sprintf("%d", from+1)
+	}
+	return fmt.Sprintf("%d,%d", from+1, to-from)
+}
+
+// splitLines splits content after each newline. Only the last line can lack
+// one, which the diff then reports.
+func splitLines(content []byte) [][]byte {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes the edit script from a to b through their longest
+// common subsequence. Config files are small enough for the quadratic table.
+func diffLines(a [][]byte, b [][]byte) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if bytes.Equal(a[i], b[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case bytes.Equal(a[i], b[j]):
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
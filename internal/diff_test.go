@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	numbered := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{
+			"changed line",
+			"a\nb\nc\n", "a\nx\nc\n",
+			"--- a\n+++ b\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n",
+		},
+		{
+			"added to empty",
+			"", "x\n",
+			"--- a\n+++ b\n@@ -0,0 +1 @@\n+x\n",
+		},
+		{
+			"removed everything",
+			"x\ny\n", "",
+			"--- a\n+++ b\n@@ -1,2 +0,0 @@\n-x\n-y\n",
+		},
+		{
+			"newline removed at end",
+			"a\n", "a",
+			"--- a\n+++ b\n@@ -1 +1 @@\n-a\n+a\n\\ No newline at end of file\n",
+		},
+		{
+			"separate hunks",
+			numbered, strings.Replace(strings.Replace(numbered, "1\n", "one\n", 1), "10\n", "ten\n", 1),
+			"--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+ten\n",
+		},
+		{
+			"nearby changes share a hunk",
+			numbered, strings.Replace(strings.Replace(numbered, "2\n", "two\n", 1), "8\n", "eight\n", 1),
+			"--- a\n+++ b\n@@ -1,10 +1,10 @@\n 1\n-2\n+two\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n 9\n 10\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := unifiedDiff("a", "b", []byte(test.a), []byte(test.b)); got != test.want {
+				t.Errorf("unifiedDiff(%q, %q) =\n%s\nwant\n%s", test.a, test.b, got, test.want)
+			}
+		})
+	}
+}
+
+// TestUnifiedDiffApplies checks that applying random diffs to the old file
+// reproduces the new one exactly, with every context and removed line
+// matching.
+func TestUnifiedDiffApplies(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		a := randomFile(random)
+		b := editFile(random, a)
+		diff := unifiedDiff("a", "b", a, b)
+
+		got, err := applyUnifiedDiff(a, diff)
+		if err != nil {
+			t.Fatalf("case %d: %v\na: %q\nb: %q\ndiff:\n%s", i, err, a, b, diff)
+		}
+		if !bytes.Equal(got, b) {
+			t.Fatalf("case %d: applying the diff gave %q, want %q\ndiff:\n%s", i, got, b, diff)
+		}
+	}
+}
+
+// randomFile returns up to 20 lines from a small alphabet, so that lines
+// repeat, sometimes without a final newline.
+func randomFile(random *rand.Rand) []byte {
+	var buf bytes.Buffer
+	for n := random.Intn(21); n > 0; n-- {
+		buf.WriteString(strconv.Itoa(random.Intn(5)) + "\n")
+	}
+	if buf.Len() > 0 && random.Intn(4) == 0 {
+		buf.Truncate(buf.Len() - 1)
+	}
+	return buf.Bytes()
+}
+
+func editFile(random *rand.Rand, a []byte) []byte {
+	lines := splitLines(a)
+	var edited [][]byte
+	for _, line := range lines {
+		switch random.Intn(6) {
+		case 0:
+			// deleted
+		case 1:
+			edited = append(edited, []byte("new\n"), line)
+		case 2:
+			edited = append(edited, []byte("changed\n"))
+		default:
+			edited = append(edited, line)
+		}
+	}
+	if random.Intn(3) == 0 {
+		edited = append(edited, []byte("end\n"))
+	}
+	b := bytes.Join(edited, nil)
+	if len(b) > 0 && bytes.HasSuffix(b, []byte("\n")) && random.Intn(4) == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// applyUnifiedDiff applies diff to a like patch does, but refuses any
+// context or removed line that does not match a exactly.
+func applyUnifiedDiff(a []byte, diff string) ([]byte, error) {
+	if diff == "" {
+		return a, nil
+	}
+	lines := splitLines(a)
+	diffLines := strings.SplitAfter(diff, "\n")
+	diffLines = diffLines[2 : len(diffLines)-1]
+
+	var out [][]byte
+	pos := 0
+	for k := 0; k < len(diffLines); {
+		var from, count int
+		header := diffLines[k]
+		if _, err := fmt.Sscanf(header, "@@ -%d,%d", &from, &count); err != nil {
+			count = 1
+			if _, err := fmt.Sscanf(header, "@@ -%d", &from); err != nil {
+				return nil, fmt.Errorf("bad hunk header %q", header)
+			}
+		}
+		start := from - 1
+		if count == 0 {
+			start = from
+		}
+		if start < pos {
+			return nil, fmt.Errorf("hunk %q overlaps the previous one", header)
+		}
+		out = append(out, lines[pos:start]...)
+		pos = start
+
+		// Collect the hunk's lines first, a marker changes the line before it
+		type op struct {
+			kind byte
+			line []byte
+		}
+		var ops []op
+		for k++; k < len(diffLines) && !strings.HasPrefix(diffLines[k], "@@"); k++ {
+			if strings.HasPrefix(diffLines[k], "\\ No newline at end of file") {
+				last := &ops[len(ops)-1]
+				last.line = bytes.TrimSuffix(last.line, []byte("\n"))
+				continue
+			}
+			ops = append(ops, op{diffLines[k][0], []byte(diffLines[k][1:])})
+		}
+
+		for _, o := range ops {
+			if o.kind != '+' {
+				if pos >= len(lines) || !bytes.Equal(lines[pos], o.line) {
+					return nil, fmt.Errorf("line %d does not match %q", pos+1, o.line)
+				}
+				pos++
+			}
+			if o.kind != '-' {
+				out = append(out, o.line)
+			}
+		}
+	}
+	out = append(out, lines[pos:]...)
+	return bytes.Join(out, nil), nil
+}
+
+func TestDiffAppMissingFile(t *testing.T) {
+	repo := useTestStore(t)
+	mustCommit(t, repo, "Add web", FileChange{Path: "app/docker-compose/web.yml", Content: []byte("web: 1\n")})
+	options := DiffOptions{LocalDir: filepath.Dir(writeTestFile(t, "web.yml", "web: 1\n")), SkipServer: true}
+
+	if differ, err := DiffApp("app", "web.yml", options); differ || err != nil {
+		t.Errorf("DiffApp of an unchanged file = %v, %v, want false, nil", differ, err)
+	}
+	if _, err := DiffApp("app", "db.yml", options); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DiffApp of a missing file = %v, want ErrNotFound", err)
+	}
+}
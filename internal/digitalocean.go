@@ -3,118 +3,204 @@ package internal
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"net/http"
+	"strconv"
 
 	"github.com/digitalocean/godo"
 )
 
-var client = godo.NewFromToken(os.Getenv("DO_ACCESS_TOKEN"))
+type digitalOceanProvider struct {
+	client *godo.Client
+}
 
-func createDroplet(name string, size string) int {
-	createRequest := &godo.DropletCreateRequest{
-		Name:   name,
-		Region: "nyc3",
-		Size:   size,
-		Image: godo.DropletCreateImage{
-			Slug: "ubuntu-18-04-x64",
-		},
-		SSHKeys: []godo.DropletCreateSSHKey{godo.DropletCreateSSHKey{
-			Fingerprint: addSSHKey(name),
-		}},
-	}
+func newDigitalOceanProvider(token string) *digitalOceanProvider {
+	return &digitalOceanProvider{godo.NewFromToken(token)}
+}
 
-	ctx := context.TODO()
+func (p *digitalOceanProvider) Name() string {
+	return "digitalocean"
+}
 
-	newDroplet, _, err := client.Droplets.Create(ctx, createRequest)
+func (p *digitalOceanProvider) RegisterKey(name string, publicKey []byte) (string, error) {
+	createRequest := &godo.KeyCreateRequest{
+		Name:      name,
+		PublicKey: string(publicKey),
+	}
 
+	newKey, _, err := p.client.Keys.Create(context.TODO(), createRequest)
 	if err != nil {
-		fmt.Printf("Error creating new droplet: %s\n\n", err)
-		os.Exit(1)
+		return "", fmt.Errorf("error adding new SSH key for %s onto DigitalOcean: %s: %w", name, err, ErrProviderFailure)
 	}
-
-	return newDroplet.ID
+	return strconv.Itoa(newKey.ID), nil
 }
 
-func addSSHKey(name string) string {
-	homeDir, _ := os.UserHomeDir()
-	keyPath := filepath.Join(homeDir, ".send", name, "server.pem.pub")
+func (p *digitalOceanProvider) DeleteKey(keyID string) error {
+	id, err := strconv.Atoi(keyID)
+	if err != nil {
+		return fmt.Errorf("invalid DigitalOcean key id %q: %w", keyID, ErrInvalidInput)
+	}
 
-	publicKey, _ := ioutil.ReadFile(keyPath)
+	if response, err := p.client.Keys.DeleteByID(context.TODO(), id); err != nil && !isNotFound(response) {
+		return fmt.Errorf("error deleting SSH key %d from DigitalOcean: %s: %w", id, err, ErrProviderFailure)
+	}
+	return nil
+}
 
-	createRequest := &godo.KeyCreateRequest{
-		Name:      name,
-		PublicKey: string(publicKey),
+func (p *digitalOceanProvider) CreateServer(name string, options ServerOptions, keyID string) (string, error) {
+	id, err := strconv.Atoi(keyID)
+	if err != nil {
+		return "", fmt.Errorf("invalid DigitalOcean key id %q: %w", keyID, ErrInvalidInput)
 	}
 
-	newKey, _, err := client.Keys.Create(context.TODO(), createRequest)
+	createRequest := &godo.DropletCreateRequest{
+		Name:   name,
+		Region: options.Region,
+		Size:   options.Size,
+		Image: godo.DropletCreateImage{
+			Slug: options.Image,
+		},
+		SSHKeys:    []godo.DropletCreateSSHKey{{ID: id}},
+		Tags:       options.Tags,
+		VPCUUID:    options.VPC,
+		IPv6:       options.IPv6,
+		Monitoring: options.Monitoring,
+		Backups:    options.Backups,
+	}
 
+	newDroplet, _, err := p.client.Droplets.Create(context.TODO(), createRequest)
 	if err != nil {
-		fmt.Printf("Error adding new SSH key for %s onto DigitalOcean\n", name)
-		os.Exit(1)
+		return "", fmt.Errorf("error creating new droplet: %s: %w", err, ErrProviderFailure)
 	}
-
-	return newKey.Fingerprint
+	return strconv.Itoa(newDroplet.ID), nil
 }
 
-func getDroplet(id int) *godo.Droplet {
-	droplet, _, err := client.Droplets.Get(context.TODO(), id)
+func (p *digitalOceanProvider) GetServer(serverID string) (*Server, error) {
+	id, err := strconv.Atoi(serverID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid droplet id %q: %w", serverID, ErrInvalidInput)
+	}
 
+	droplet, _, err := p.client.Droplets.Get(context.TODO(), id)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching droplet with id %d: %s: %w", id, err, ErrProviderFailure)
+	}
+	ip, err := droplet.PublicIPv4()
 	if err != nil {
-		fmt.Printf("Error fetching droplet with id %d: %s \n", id, err)
-		os.Exit(1)
+		return nil, fmt.Errorf("error reading IP of droplet %d: %s: %w", id, err, ErrProviderFailure)
 	}
-	return droplet
+	return &Server{serverID, droplet.Status, ip}, nil
 }
 
-func getDropletIP(id int) string {
-	droplet := getDroplet(id)
+func (p *digitalOceanProvider) DestroyServer(serverID string) error {
+	id, err := strconv.Atoi(serverID)
+	if err != nil {
+		return fmt.Errorf("invalid droplet id %q: %w", serverID, ErrInvalidInput)
+	}
 
-	ip, _ := droplet.PublicIPv4()
-	return ip
+	if response, err := p.client.Droplets.Delete(context.TODO(), id); err != nil && !isNotFound(response) {
+		return fmt.Errorf("error destroying droplet %d: %s: %w", id, err, ErrProviderFailure)
+	}
+	return nil
 }
 
-func getDropletStatus(id int) string {
-	droplet := getDroplet(id)
-	return droplet.Status
+func (p *digitalOceanProvider) DefaultServerOptions(options ServerOptions) ServerOptions {
+	if options.Size == "" {
+		options.Size = "s-1vcpu-1gb"
+	}
+	if options.Region == "" {
+		options.Region = "nyc3"
+	}
+	if options.Image == "" {
+		options.Image = "ubuntu-18-04-x64"
+	}
+	return options
 }
 
-func getValidSizes() []godo.Size {
-	var sizes []godo.Size
+// doFeatures maps DigitalOcean region features to the ones options use.
+// Monitoring is provided by the agent installed on new droplets.
+var doFeatures = map[string]string{
+	"ipv6":          FeatureIPv6,
+	"backups":       FeatureBackups,
+	"install_agent": FeatureMonitoring,
+}
+
+func (p *digitalOceanProvider) ListRegions() ([]Region, error) {
+	doRegions, _, err := p.client.Regions.List(context.TODO(), &godo.ListOptions{PerPage: 200})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching regions: %s: %w", err, ErrProviderFailure)
+	}
 
-	dropletSizes, _, err := client.Sizes.List(context.TODO(), nil)
+	var regions []Region
+	for _, region := range doRegions {
+		if !region.Available {
+			continue
+		}
+		var features []string
+		for _, feature := range region.Features {
+			if mapped, ok := doFeatures[feature]; ok {
+				features = append(features, mapped)
+			}
+		}
+		regions = append(regions, Region{region.Slug, region.Name, features})
+	}
+	return regions, nil
+}
 
+func (p *digitalOceanProvider) ListSizes(region string) ([]Size, error) {
+	dropletSizes, _, err := p.client.Sizes.List(context.TODO(), &godo.ListOptions{PerPage: 200})
 	if err != nil {
-		fmt.Printf("Error fetching droplet sizes: %s \n", err)
+		return nil, fmt.Errorf("error fetching droplet sizes: %s: %w", err, ErrProviderFailure)
 	}
 
+	var sizes []Size
 	for _, size := range dropletSizes {
-		if contains(size.Regions, "nyc3") {
-			sizes = append(sizes, size)
+		if size.Available && contains(size.Regions, region) {
+			sizes = append(sizes, Size{size.Slug, size.Memory, size.Vcpus, size.Disk})
 		}
 	}
-
-	return sizes
+	return sizes, nil
 }
 
-func IsDropletSizeValid(sizeSlug string) bool {
-	for _, size := range getValidSizes() {
-		if size.Slug == sizeSlug {
-			return true
+func (p *digitalOceanProvider) ListImages(region string) ([]string, error) {
+	var images []string
+	options := &godo.ListOptions{PerPage: 200}
+	for {
+		doImages, response, err := p.client.Images.ListDistribution(context.TODO(), options)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching images: %s: %w", err, ErrProviderFailure)
+		}
+		for _, image := range doImages {
+			if image.Slug != "" && contains(image.Regions, region) {
+				images = append(images, image.Slug)
+			}
 		}
+		if response.Links == nil || response.Links.IsLastPage() {
+			return images, nil
+		}
+		page, err := response.Links.CurrentPage()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching images: %s: %w", err, ErrProviderFailure)
+		}
+		options.Page = page + 1
 	}
-
-	return false
 }
 
-func GetValidSizeStrings() []string {
-	var sizes []string
+func (p *digitalOceanProvider) ListVPCs() ([]VPC, error) {
+	doVPCs, _, err := p.client.VPCs.List(context.TODO(), &godo.ListOptions{PerPage: 200})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching VPCs: %s: %w", err, ErrProviderFailure)
+	}
 
-	for _, size := range getValidSizes() {
-		str := fmt.Sprintf("%s \t Memory: %d, Vcpus: %d, Disk: %d", size.Slug, size.Memory, size.Vcpus, size.Disk)
-		sizes = append(sizes, str)
+	var vpcs []VPC
+	for _, vpc := range doVPCs {
+		vpcs = append(vpcs, VPC{vpc.ID, vpc.Name, vpc.RegionSlug})
 	}
+	return vpcs, nil
+}
 
-	return sizes
+// isNotFound reports whether a request failed because what it refers to is
+// already gone. Deleting it again then succeeds, so destroying an app can be
+// retried.
+func isNotFound(response *godo.Response) bool {
+	return response != nil && response.Response != nil && response.StatusCode == http.StatusNotFound
 }
@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+type smtpNotifier struct {
+	host     string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+func (s *smtpNotifier) Notify(n Notification) error {
+	subject := "[send] " + n.Text
+	if n.App != "" {
+		subject = fmt.Sprintf("[send] %s: %s", n.App, n.Text)
+	}
+
+	body := n.Text + "\r\n"
+	if n.App != "" {
+		body += "\r\nApp: " + n.App
+	}
+	if n.User != "" {
+		body += "\r\nUser: " + n.User
+	}
+
+	message := strings.Join([]string{
+		"From: " + s.from,
+		"To: " + strings.Join(s.to, ", "),
+		"Subject: " + strings.NewReplacer("\r", " ", "\n", " ").Replace(subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	}, "\r\n")
+
+	var auth smtp.Auth
+	if s.username != "" {
+		hostname, _, _ := net.SplitHostPort(s.host)
+		auth = smtp.PlainAuth("", s.username, s.password, hostname)
+	}
+	return smtp.SendMail(s.host, auth, s.from, s.to, []byte(message))
+}
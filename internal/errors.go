@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidInput       = errors.New("invalid input")
+	ErrLoginRequired      = errors.New("login required")
+	ErrInvalidCredentials = errors.New("username doesn't exist or password is incorrect")
+	ErrAccessDenied       = errors.New("access denied")
+	ErrNotFound           = errors.New("not found")
+	ErrUserNotFound       = errors.New("user does not exist")
+	ErrAppNotFound        = errors.New("app does not exist")
+	ErrConflict           = errors.New("conflicting change")
+	ErrStoreFailure       = errors.New("config store request failed")
+	ErrRemoteFailure      = errors.New("command on server failed")
+	ErrProviderFailure    = errors.New("cloud provider request failed")
+	ErrHostKeyMismatch    = errors.New("server host key could not be verified")
+	ErrConfigDiffers      = errors.New("copies of the config differ")
+	ErrInterrupted        = errors.New("interrupted")
+)
+
+// ExitStatusError reports that a command run on an app's server exited with a
+// non-zero status. The CLI exits with the same status.
+type ExitStatusError struct {
+	Status int
+}
+
+func (e *ExitStatusError) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.Status)
+}
+
+func (e *ExitStatusError) Unwrap() error {
+	return ErrRemoteFailure
+}
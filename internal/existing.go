@@ -0,0 +1,68 @@
+package internal
+
+import "fmt"
+
+// existingProvider uses a server that was set up outside of send. It cannot
+// install keys or destroy the server, so it asks for the former and leaves
+// the latter to whoever owns the server.
+type existingProvider struct {
+	ip string
+}
+
+func newExistingProvider(ip string) *existingProvider {
+	return &existingProvider{ip}
+}
+
+func (p *existingProvider) Name() string {
+	return "existing"
+}
+
+// RegisterKey asks for the key to be installed by hand. Provisioning keeps
+// retrying to connect until it is.
+func (p *existingProvider) RegisterKey(name string, publicKey []byte) (string, error) {
+	fmt.Printf("Add this key to ~%s/.ssh/authorized_keys on %s, provisioning continues once it is accepted:\n\n%s\n", sshUser, p.ip, publicKey)
+	return "", nil
+}
+
+func (p *existingProvider) DeleteKey(keyID string) error {
+	fmt.Printf("Remove the key of the app from ~%s/.ssh/authorized_keys on %s\n", sshUser, p.ip)
+	return nil
+}
+
+func (p *existingProvider) CreateServer(name string, options ServerOptions, keyID string) (string, error) {
+	if p.ip == "" {
+		return "", fmt.Errorf("the existing provider needs the IP of the server: %w", ErrInvalidInput)
+	}
+	return p.ip, nil
+}
+
+func (p *existingProvider) GetServer(serverID string) (*Server, error) {
+	return &Server{serverID, ServerActive, serverID}, nil
+}
+
+func (p *existingProvider) DestroyServer(serverID string) error {
+	fmt.Printf("Server %s was not created by send and is left running\n", serverID)
+	return nil
+}
+
+// The server already exists, so there is nothing to choose and the options
+// are only recorded.
+func (p *existingProvider) DefaultServerOptions(options ServerOptions) ServerOptions {
+	return options
+}
+
+func (p *existingProvider) ListRegions() ([]Region, error) {
+	return nil, nil
+}
+
+func (p *existingProvider) ListSizes(region string) ([]Size, error) {
+	return nil, nil
+}
+
+func (p *existingProvider) ListImages(region string) ([]string, error) {
+	return nil, nil
+}
+
+func (p *existingProvider) ListVPCs() ([]VPC, error) {
+	return nil, nil
+}
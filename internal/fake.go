@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"strconv"
+	"sync"
+)
+
+// fakeProvider pretends to create servers, all of which are reachable at the
+// same IP. It keeps everything in memory, so it only knows about servers
+// created by the running command, and is meant for exercising provisioning
+// against a local SSH server.
+type fakeProvider struct {
+	mutex   sync.Mutex
+	ip      string
+	next    int
+	keys    map[string][]byte
+	servers map[string]*Server
+}
+
+func newFakeProvider(ip string) *fakeProvider {
+	return &fakeProvider{ip: ip, keys: map[string][]byte{}, servers: map[string]*Server{}}
+}
+
+func (p *fakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakeProvider) RegisterKey(name string, publicKey []byte) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.next++
+	id := "key-" + strconv.Itoa(p.next)
+	p.keys[id] = publicKey
+	return id, nil
+}
+
+func (p *fakeProvider) DeleteKey(keyID string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.keys, keyID)
+	return nil
+}
+
+func (p *fakeProvider) CreateServer(name string, options ServerOptions, keyID string) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.next++
+	id := "server-" + strconv.Itoa(p.next)
+	p.servers[id] = &Server{ID: id, Status: "new"}
+	return id, nil
+}
+
+// GetServer reports a new server as active from the second time it is asked
+// for, like a real one that takes a while to boot. Servers created by earlier
+// commands, such as an interrupted provisioning, are unknown and reported as
+// active right away.
+func (p *fakeProvider) GetServer(serverID string) (*Server, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	server, ok := p.servers[serverID]
+	if !ok {
+		return &Server{serverID, ServerActive, p.ip}, nil
+	}
+	current := *server
+	server.Status, server.IP = ServerActive, p.ip
+	return &current, nil
+}
+
+// DestroyServer forgets the server. Servers created by earlier commands are
+// unknown, so destroying them succeeds without doing anything.
+func (p *fakeProvider) DestroyServer(serverID string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.servers, serverID)
+	return nil
+}
+
+func (p *fakeProvider) DefaultServerOptions(options ServerOptions) ServerOptions {
+	if options.Size == "" {
+		options.Size = "fake-small"
+	}
+	if options.Region == "" {
+		options.Region = "fake-1"
+	}
+	if options.Image == "" {
+		options.Image = "fake-image"
+	}
+	return options
+}
+
+// fake-2 lacks every optional feature, to exercise their validation.
+func (p *fakeProvider) ListRegions() ([]Region, error) {
+	return []Region{
+		{"fake-1", "Fake 1", []string{FeatureIPv6, FeatureBackups, FeatureMonitoring}},
+		{"fake-2", "Fake 2", nil},
+	}, nil
+}
+
+func (p *fakeProvider) ListSizes(region string) ([]Size, error) {
+	return []Size{{"fake-small", 1024, 1, 25}, {"fake-large", 4096, 2, 80}}, nil
+}
+
+func (p *fakeProvider) ListImages(region string) ([]string, error) {
+	return []string{"fake-image"}, nil
+}
+
+func (p *fakeProvider) ListVPCs() ([]VPC, error) {
+	return []VPC{{"fake-vpc-1", "default-fake-1", "fake-1"}, {"fake-vpc-2", "default-fake-2", "fake-2"}}, nil
+}
@@ -3,20 +3,16 @@ package internal
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/tidwall/gjson"
 )
 
-const baseURL = "https://github.coecis.cornell.edu/api/v3/repos/cuappdev/send-devops/"
-const contentURL = baseURL + "contents/"
-const gitURL = baseURL + "git/"
-
 type blobRequest struct {
 	Content  string `json:"content"`
 	Encoding string `json:"encoding"`
@@ -32,148 +28,414 @@ type fileRequest struct {
 	Message string `json:"message"`
 	Content string `json:"content"`
 	Branch  string `json:"branch"`
-	SHA     string `json:"sha"`
+	SHA     string `json:"sha,omitempty"`
 }
 
 type referenceRequest struct {
+	SHA   string `json:"sha"`
+	Force bool   `json:"force"`
+}
+
+type newReferenceRequest struct {
+	Ref string `json:"ref"`
 	SHA string `json:"sha"`
 }
 
+type pullRequestRequest struct {
+	Title string `json:"title"`
+	Head  string `json:"head"`
+	Base  string `json:"base"`
+	Body  string `json:"body"`
+}
+
+type mergeRequest struct {
+	CommitTitle string `json:"commit_title"`
+	SHA         string `json:"sha"`
+	MergeMethod string `json:"merge_method"`
+}
+
 type treeRequest struct {
 	Tree     []tree `json:"tree"`
 	BaseTree string `json:"base_tree"`
 }
 
 type tree struct {
-	Path string `json:"path"`
-	Mode string `json:"mode"`
-	Type string `json:"type"`
-	SHA  string `json:"sha"`
+	Path string  `json:"path"`
+	Mode string  `json:"mode"`
+	Type string  `json:"type"`
+	SHA  *string `json:"sha"`
 }
 
 type user struct {
-	Username       string   `json:"username"`
-	HashedPassword string   `json:"hashed_password"`
-	Apps           []string `json:"apps"`
-	IsAdmin        bool     `json:"is_admin"`
+	Username       string            `json:"username"`
+	HashedPassword string            `json:"hashed_password"`
+	Apps           []string          `json:"apps,omitempty"`
+	Roles          map[string]string `json:"roles"`
+	IsAdmin        bool              `json:"is_admin"`
+	SchemaVersion  int               `json:"schema_version"`
+	ResetCode      string            `json:"reset_code,omitempty"`
+	ResetExpiresAt int64             `json:"reset_expires_at,omitempty"`
 }
 
-func getContents(path string) []byte {
-	contentsLink := contentURL + path
-	res, statusCode := performRequest("GET", contentsLink, nil)
+type gitHubStore struct {
+	repoURL string
+	branch  string
+}
+
+func NewGitHubStore(apiURL string, repository string, branch string) ConfigStore {
+	return &gitHubStore{strings.TrimSuffix(apiURL, "/") + "/repos/" + repository + "/", branch}
+}
 
+func (s *gitHubStore) ReadFile(path string) (*File, error) {
+	return s.ReadFileAt(path, s.branch)
+}
+
+func (s *gitHubStore) ReadFileAt(path string, ref string) (*File, error) {
+	res, statusCode, err := performRequest("GET", s.repoURL+"contents/"+path+"?ref="+ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode == 404 {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotFound)
+	}
 	if statusCode != 200 {
-		return nil
+		return nil, fmt.Errorf("error fetching %s: status %d: %w", path, statusCode, ErrStoreFailure)
+	}
+
+	if !gjson.GetBytes(res, "content").Exists() {
+		return nil, fmt.Errorf("%s is not a file", path)
+	}
+	content, err := base64.StdEncoding.DecodeString(gjson.GetBytes(res, "content").String())
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %w", path, err)
 	}
 
-	return res
+	return &File{
+		gjson.GetBytes(res, "name").String(),
+		gjson.GetBytes(res, "path").String(),
+		"file",
+		gjson.GetBytes(res, "sha").String(),
+		content,
+	}, nil
 }
 
-func getFile(path string) map[string]interface{} {
-	var jsonRes map[string]interface{}
-	json.Unmarshal(getContents(path), &jsonRes)
+func (s *gitHubStore) ListDir(path string) ([]*File, error) {
+	return s.ListDirAt(path, s.branch)
+}
 
-	return jsonRes
+func (s *gitHubStore) ListDirAt(path string, ref string) ([]*File, error) {
+	res, statusCode, err := performRequest("GET", s.repoURL+"contents/"+path+"?ref="+ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode == 404 {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotFound)
+	}
+	if statusCode != 200 || !gjson.ParseBytes(res).IsArray() {
+		return nil, fmt.Errorf("error listing %s: status %d: %w", path, statusCode, ErrStoreFailure)
+	}
+
+	var files []*File
+	for _, entry := range gjson.ParseBytes(res).Array() {
+		files = append(files, &File{
+			Name: entry.Get("name").String(),
+			Path: entry.Get("path").String(),
+			Type: entry.Get("type").String(),
+			SHA:  entry.Get("sha").String(),
+		})
+	}
+	return files, nil
 }
 
-func getDirectory(path string) []map[string]interface{} {
-	var jsonRes []map[string]interface{}
-	json.Unmarshal(getContents(path), &jsonRes)
+func (s *gitHubStore) WriteFile(path string, content []byte, sha string, message string) (string, error) {
+	body, _ := json.Marshal(fileRequest{
+		message,
+		base64.StdEncoding.Strict().EncodeToString(content),
+		s.branch,
+		sha,
+	})
 
-	return jsonRes
+	res, statusCode, err := performRequest("PUT", s.repoURL+"contents/"+path, body)
+	if err != nil {
+		return "", err
+	}
+	if statusCode == 409 || statusCode == 422 {
+		return "", fmt.Errorf("%s: %w", path, ErrConflict)
+	}
+	if statusCode != 200 && statusCode != 201 {
+		return "", fmt.Errorf("error writing %s: status %d: %w", path, statusCode, ErrStoreFailure)
+	}
+
+	return gjson.GetBytes(res, "commit.sha").String(), nil
 }
 
-func downloadFile(file map[string]interface{}, outDir string) (success bool) {
-	if file["download_url"] != nil {
-		downloadLink := file["download_url"].(string)
-		cmd := exec.Command(
-			"curl",
-			"--output",
-			filepath.Join(outDir, file["name"].(string)),
-			"-L",
-			downloadLink,
-		)
+func (s *gitHubStore) Commit(message string, changes []FileChange) (string, error) {
+	headSHA, err := s.headSHA()
+	if err != nil {
+		return "", err
+	}
+	commitSHA, err := s.commitChanges(headSHA, message, changes)
+	if err != nil {
+		return "", err
+	}
 
-		_, err := cmd.Output()
-		if err != nil {
-			fmt.Printf("error occurred downloading the file %s to %s : %s\n", file["name"].(string), outDir, err)
-			return false
+	refBody, _ := json.Marshal(referenceRequest{commitSHA, false})
+	_, statusCode, err := performRequest("PATCH", s.repoURL+"git/refs/heads/"+s.branch, refBody)
+	if err != nil {
+		return "", err
+	}
+	if statusCode == 422 {
+		return "", fmt.Errorf("%s moved during commit: %w", s.branch, ErrConflict)
+	}
+	if statusCode != 200 {
+		return "", fmt.Errorf("error updating %s with new commit: status %d: %w", s.branch, statusCode, ErrStoreFailure)
+	}
+
+	return commitSHA, nil
+}
+
+// commitChanges creates a commit applying changes on top of parentSHA without
+// moving any branch.
+func (s *gitHubStore) commitChanges(parentSHA string, message string, changes []FileChange) (string, error) {
+	var files []tree
+	for _, change := range changes {
+		if change.SHA != "" {
+			current, err := s.ReadFileAt(change.Path, parentSHA)
+			if errors.Is(err, ErrNotFound) || (err == nil && current.SHA != change.SHA) {
+				return "", fmt.Errorf("%s changed: %w", change.Path, ErrConflict)
+			}
+			if err != nil {
+				return "", err
+			}
 		}
-		return true
+		entry := tree{change.Path, "100644", "blob", nil}
+		if !change.Delete {
+			blobSHA, err := s.createBlob(change.Content)
+			if err != nil {
+				return "", err
+			}
+			entry.SHA = &blobSHA
+		}
+		files = append(files, entry)
+	}
+
+	treeSHA, err := s.createTree(parentSHA, files)
+	if err != nil {
+		return "", err
+	}
+	return s.createCommit(message, treeSHA, parentSHA)
+}
+
+func (s *gitHubStore) OpenPullRequest(branch string, title string, body string, changes []FileChange) (*PullRequest, error) {
+	headSHA, err := s.headSHA()
+	if err != nil {
+		return nil, err
+	}
+	commitSHA, err := s.commitChanges(headSHA, title, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	refBody, _ := json.Marshal(newReferenceRequest{"refs/heads/" + branch, commitSHA})
+	_, statusCode, err := performRequest("POST", s.repoURL+"git/refs", refBody)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode == 422 {
+		return nil, fmt.Errorf("branch %s already exists: %w", branch, ErrConflict)
+	}
+	if statusCode != 201 {
+		return nil, fmt.Errorf("error creating branch %s: status %d: %w", branch, statusCode, ErrStoreFailure)
 	}
-	return false
+
+	pullBody, _ := json.Marshal(pullRequestRequest{title, branch, s.branch, body})
+	res, statusCode, err := performRequest("POST", s.repoURL+"pulls", pullBody)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode != 201 {
+		return nil, fmt.Errorf("error opening pull request for %s: status %d: %w", branch, statusCode, ErrStoreFailure)
+	}
+
+	return &PullRequest{
+		Number:  int(gjson.GetBytes(res, "number").Int()),
+		Title:   title,
+		Body:    body,
+		URL:     gjson.GetBytes(res, "html_url").String(),
+		State:   "open",
+		Branch:  branch,
+		HeadSHA: commitSHA,
+		Changes: changes,
+	}, nil
 }
 
-func createBlobs(app string, files *[]tree) filepath.WalkFunc {
-	return func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
+func (s *gitHubStore) GetPullRequest(number int) (*PullRequest, error) {
+	pullURL := fmt.Sprintf("%spulls/%d", s.repoURL, number)
+	res, statusCode, err := performRequest("GET", pullURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode == 404 {
+		return nil, fmt.Errorf("pull request #%d: %w", number, ErrNotFound)
+	}
+	if statusCode != 200 {
+		return nil, fmt.Errorf("error fetching pull request #%d: status %d: %w", number, statusCode, ErrStoreFailure)
+	}
+
+	pr := &PullRequest{
+		Number:  number,
+		Title:   gjson.GetBytes(res, "title").String(),
+		Body:    gjson.GetBytes(res, "body").String(),
+		URL:     gjson.GetBytes(res, "html_url").String(),
+		State:   gjson.GetBytes(res, "state").String(),
+		Branch:  gjson.GetBytes(res, "head.ref").String(),
+		HeadSHA: gjson.GetBytes(res, "head.sha").String(),
+	}
+	if gjson.GetBytes(res, "merged").Bool() {
+		pr.State = "merged"
+	}
+
+	res, statusCode, err = performRequest("GET", pullURL+"/files?per_page=100", nil)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode != 200 {
+		return nil, fmt.Errorf("error fetching files of pull request #%d: status %d: %w", number, statusCode, ErrStoreFailure)
+	}
+	for _, file := range gjson.ParseBytes(res).Array() {
+		status := file.Get("status").String()
+		if status == "renamed" {
+			pr.Changes = append(pr.Changes, FileChange{Path: file.Get("previous_filename").String(), Delete: true})
 		}
+		pr.Changes = append(pr.Changes, FileChange{Path: file.Get("filename").String(), Delete: status == "removed"})
+	}
+	return pr, nil
+}
+
+func (s *gitHubStore) MergePullRequest(number int, headSHA string, message string) (string, error) {
+	pr, err := s.GetPullRequest(number)
+	if err != nil {
+		return "", err
+	}
 
-		data, err := ioutil.ReadFile(path)
+	body, _ := json.Marshal(mergeRequest{message, headSHA, "merge"})
+	res, statusCode, err := performRequest("PUT", fmt.Sprintf("%spulls/%d/merge", s.repoURL, number), body)
+	if err != nil {
+		return "", err
+	}
+	if statusCode == 405 || statusCode == 409 {
+		return "", fmt.Errorf("pull request #%d cannot be merged: %s: %w", number, gjson.GetBytes(res, "message").String(), ErrConflict)
+	}
+	if statusCode != 200 {
+		return "", fmt.Errorf("error merging pull request #%d: status %d: %w", number, statusCode, ErrStoreFailure)
+	}
+
+	// The branch has served its purpose, failing to delete it is harmless
+	performRequest("DELETE", s.repoURL+"git/refs/heads/"+pr.Branch, nil)
+	return gjson.GetBytes(res, "sha").String(), nil
+}
+
+// historyPageSize is the most commits GitHub returns per page.
+const historyPageSize = 100
+
+func (s *gitHubStore) History(path string) ([]Revision, error) {
+	var revisions []Revision
+	for page := 1; ; page++ {
+		pageURL := fmt.Sprintf("%scommits?sha=%s&path=%s&per_page=%d&page=%d", s.repoURL, s.branch, path, historyPageSize, page)
+		res, statusCode, err := performRequest("GET", pageURL, nil)
 		if err != nil {
-			fmt.Println(err.Error())
-			os.Exit(1)
+			return nil, err
 		}
-		requestBody := blobRequest{
-			base64.StdEncoding.Strict().EncodeToString(data),
-			"base64",
+		if statusCode != 200 {
+			return nil, fmt.Errorf("error fetching history of %s: status %d: %w", path, statusCode, ErrStoreFailure)
 		}
-		body, _ := json.Marshal(requestBody)
 
-		res, statusCode := performRequest("POST", gitURL+"blobs", body)
-
-		if statusCode != 201 {
-			fmt.Println("error trying to create git blob")
-			os.Exit(1)
+		commits := gjson.ParseBytes(res).Array()
+		for _, commit := range commits {
+			date, _ := time.Parse(time.RFC3339, commit.Get("commit.author.date").String())
+			revisions = append(revisions, Revision{
+				commit.Get("sha").String(),
+				commit.Get("commit.author.name").String(),
+				commit.Get("commit.message").String(),
+				date,
+			})
+		}
+		// A short page is the last one
+		if len(commits) < historyPageSize {
+			return revisions, nil
 		}
-
-		*files = append(*files, tree{
-			path[strings.LastIndex(path, app):],
-			"100644",
-			"blob",
-			gjson.GetBytes(res, "sha").String(),
-		})
-		return nil
 	}
 }
 
-func createTree(files []tree) (treeSHA string) {
-	treeBody, _ := json.Marshal(treeRequest{
-		files,
-		getMasterSHA(),
+func (s *gitHubStore) createBlob(content []byte) (string, error) {
+	body, _ := json.Marshal(blobRequest{
+		base64.StdEncoding.Strict().EncodeToString(content),
+		"base64",
 	})
-	treeRes, statusCode := performRequest("POST", gitURL+"trees", treeBody)
+
+	res, statusCode, err := performRequest("POST", s.repoURL+"git/blobs", body)
+	if err != nil {
+		return "", err
+	}
 	if statusCode != 201 {
-		fmt.Println("error trying to create git tree")
-		os.Exit(1)
+		return "", fmt.Errorf("error trying to create git blob: status %d: %w", statusCode, ErrStoreFailure)
 	}
 
-	return gjson.GetBytes(treeRes, "sha").String()
+	return gjson.GetBytes(res, "sha").String(), nil
 }
 
-func createCommit(app string, treeSHA string) (commitSHA string) {
-	commitBody, _ := json.Marshal(commitRequest{
-		"Add deployment bundle for new app: " + app,
-		treeSHA,
-		[]string{getMasterSHA()},
-	})
-	commitRes, statusCode := performRequest("POST", gitURL+"commits", commitBody)
+func (s *gitHubStore) createTree(baseSHA string, files []tree) (string, error) {
+	body, _ := json.Marshal(treeRequest{files, baseSHA})
+
+	res, statusCode, err := performRequest("POST", s.repoURL+"git/trees", body)
+	if err != nil {
+		return "", err
+	}
 	if statusCode != 201 {
-		fmt.Println("error trying to create git commit")
-		os.Exit(1)
+		return "", fmt.Errorf("error trying to create git tree: status %d: %w", statusCode, ErrStoreFailure)
 	}
 
-	return gjson.GetBytes(commitRes, "sha").String()
+	return gjson.GetBytes(res, "sha").String(), nil
 }
 
-func getMasterSHA() string {
-	res, statusCode := performRequest("GET", baseURL+"branches/master", nil)
+func (s *gitHubStore) createCommit(message string, treeSHA string, parentSHA string) (string, error) {
+	body, _ := json.Marshal(commitRequest{message, treeSHA, []string{parentSHA}})
 
+	res, statusCode, err := performRequest("POST", s.repoURL+"git/commits", body)
+	if err != nil {
+		return "", err
+	}
+	if statusCode != 201 {
+		return "", fmt.Errorf("error trying to create git commit: status %d: %w", statusCode, ErrStoreFailure)
+	}
+
+	return gjson.GetBytes(res, "sha").String(), nil
+}
+
+func (s *gitHubStore) headSHA() (string, error) {
+	res, statusCode, err := performRequest("GET", s.repoURL+"branches/"+s.branch, nil)
+	if err != nil {
+		return "", err
+	}
 	if statusCode != 200 {
-		fmt.Println("error fetching SHA of master")
-		os.Exit(1)
+		return "", fmt.Errorf("error fetching SHA of %s: status %d: %w", s.branch, statusCode, ErrStoreFailure)
+	}
+
+	return gjson.GetBytes(res, "commit.sha").String(), nil
+}
+
+func downloadFile(file *File, outDir string) error {
+	content := file.Content
+	if content == nil {
+		fullFile, err := getStore().ReadFile(file.Path)
+		if err != nil {
+			return fmt.Errorf("error occurred downloading the file %s to %s: %w", file.Name, outDir, err)
+		}
+		content = fullFile.Content
 	}
 
-	return gjson.GetBytes(res, "commit.sha").String()
+	if err := ioutil.WriteFile(filepath.Join(outDir, file.Name), content, 0644); err != nil {
+		return fmt.Errorf("error occurred downloading the file %s to %s: %w", file.Name, outDir, err)
+	}
+	return nil
 }
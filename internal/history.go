@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GetConfigHistory returns the commits that changed an app's docker-compose
+// files, or a single one of them if fileName is set, newest first.
+func GetConfigHistory(app string, fileName string) ([]Revision, error) {
+	dirPath := app + "/docker-compose"
+	if fileName != "" {
+		dirPath += "/" + fileName
+	}
+	return getStore().History(dirPath)
+}
+
+// findRevision resolves a possibly abbreviated commit SHA among the commits
+// that changed the app's docker-compose files.
+func findRevision(app string, sha string) (Revision, error) {
+	revisions, err := GetConfigHistory(app, "")
+	if err != nil {
+		return Revision{}, err
+	}
+
+	var matches []Revision
+	for _, revision := range revisions {
+		if strings.HasPrefix(revision.SHA, sha) {
+			matches = append(matches, revision)
+		}
+	}
+	if len(matches) == 0 {
+		return Revision{}, fmt.Errorf("no commit %s in the history of %s: %w", sha, app, ErrNotFound)
+	}
+	if len(matches) > 1 {
+		return Revision{}, fmt.Errorf("commit %s is ambiguous for %s: %w", sha, app, ErrInvalidInput)
+	}
+	return matches[0], nil
+}
+
+// planRollback works out the changes that restore an app's docker-compose
+// files to how they were after the given commit, deleting files added since.
+// The names of the push are the files that change.
+func planRollback(username string, app string, sha string) (*configPush, error) {
+	revision, err := findRevision(app, sha)
+	if err != nil {
+		return nil, err
+	}
+
+	dirPath := app + "/docker-compose"
+	target, err := getStore().ListDirAt(dirPath, revision.SHA)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	current, err := getStore().ListDir(dirPath)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	currentSHAs := map[string]string{}
+	for _, file := range current {
+		if file.Type == "file" {
+			currentSHAs[file.Name] = file.SHA
+		}
+	}
+
+	var changes []FileChange
+	var changed []string
+	targetNames := map[string]bool{}
+	for _, file := range target {
+		if file.Type != "file" {
+			continue
+		}
+		targetNames[file.Name] = true
+		if currentSHAs[file.Name] == file.SHA {
+			continue
+		}
+
+		old, err := getStore().ReadFileAt(file.Path, revision.SHA)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, FileChange{Path: file.Path, Content: old.Content, SHA: currentSHAs[file.Name]})
+		changed = append(changed, file.Name)
+	}
+	for name := range currentSHAs {
+		if !targetNames[name] {
+			changes = append(changes, FileChange{Path: dirPath + "/" + name, Delete: true, SHA: currentSHAs[name]})
+			changed = append(changed, name)
+		}
+	}
+
+	sort.Strings(changed)
+	return &configPush{
+		names:   changed,
+		changes: changes,
+		message: fmt.Sprintf("%s rolled back %s to %s", username, app, shortSHA(revision.SHA)),
+	}, nil
+}
+
+// RollbackApp restores an app's docker-compose files to how they were after
+// the given commit. The restored files are committed as a new commit and
+// copied to the app's server, and files added since are removed from both.
+// It returns the names of the files that changed.
+func RollbackApp(username string, app string, sha string) ([]string, error) {
+	rollback, err := planRollback(username, app, sha)
+	if err != nil {
+		return nil, err
+	}
+	if len(rollback.changes) == 0 {
+		return nil, nil
+	}
+	if _, err := getStore().Commit(rollback.message, rollback.changes); err != nil {
+		return nil, err
+	}
+
+	client, err := connectToApp(app)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	uploads := map[string][]byte{}
+	for _, change := range rollback.changes {
+		remotePath := "docker-compose/" + strings.TrimPrefix(change.Path, app+"/docker-compose/")
+		if change.Delete {
+			if err := client.Remove(remotePath); err != nil {
+				return nil, fmt.Errorf("error removing %s from %s: %w", remotePath, app, err)
+			}
+		} else {
+			uploads[remotePath] = change.Content
+		}
+	}
+	if err := client.Upload(uploads); err != nil {
+		return nil, fmt.Errorf("error restoring files onto %s: %w", app, err)
+	}
+	return rollback.names, nil
+}
+
+// ProposeRollback opens a pull request with the changes RollbackApp would
+// make, for apps whose changes have to be reviewed. An admin applies it with
+// ApprovePullRequest like any reviewed push.
+func ProposeRollback(username string, app string, sha string) (*PullRequest, error) {
+	rollback, err := planRollback(username, app, sha)
+	if err != nil {
+		return nil, err
+	}
+	if len(rollback.changes) == 0 {
+		return nil, fmt.Errorf("nothing to review, the files of %s are already as of %s: %w", app, sha, ErrInvalidInput)
+	}
+
+	branch := fmt.Sprintf("send/%s/%s-%d", app, username, time.Now().Unix())
+	body := fmt.Sprintf("Rollback proposed by send user %s.\n\nAn admin can merge this and copy the files to the server with `send approve NUMBER`.", username)
+	return getStore().OpenPullRequest(branch, rollback.message, body, rollback.changes)
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
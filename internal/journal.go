@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// provisionJournalFile is kept in the app's bundle directory while it is
+// being provisioned. It is never committed with the bundle.
+const provisionJournalFile = "provision-journal.json"
+
+// provisionJournal records how far provisioning an app got and what it
+// created, so an interrupted provisioning can be resumed without creating
+// anything twice.
+type provisionJournal struct {
+	Provider   string        `json:"provider"`
+	ProviderIP string        `json:"provider_ip,omitempty"`
+	Options    ServerOptions `json:"options"`
+	KeyID      string        `json:"key_id,omitempty"`
+	ServerID   string        `json:"server_id,omitempty"`
+	ServerIP   string        `json:"server_ip,omitempty"`
+	Steps      []string      `json:"steps"`
+
+	path string
+}
+
+func provisionJournalPath(app string) string {
+	return filepath.Join(homeDir, ".send", app, provisionJournalFile)
+}
+
+// checkNoProvisionJournal fails if provisioning app was interrupted, so
+// that a new provisioning does not replace its journal.
+func checkNoProvisionJournal(app string) error {
+	path := provisionJournalPath(app)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("provisioning %s was interrupted, continue it with send provision --resume %s or delete %s to start over: %w", app, app, path, ErrConflict)
+	}
+	return nil
+}
+
+func newProvisionJournal(app string, provider string, providerIP string, options ServerOptions) (*provisionJournal, error) {
+	path := provisionJournalPath(app)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	journal := &provisionJournal{Provider: provider, ProviderIP: providerIP, Options: options, path: path}
+	return journal, journal.save()
+}
+
+func loadProvisionJournal(app string) (*provisionJournal, error) {
+	path := provisionJournalPath(app)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no interrupted provisioning of %s to resume: %w", app, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	journal := &provisionJournal{path: path}
+	if err := json.Unmarshal(content, journal); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return journal, nil
+}
+
+func (j *provisionJournal) save() error {
+	content, _ := json.MarshalIndent(j, "", "\t")
+	if err := ioutil.WriteFile(j.path, content, 0600); err != nil {
+		return fmt.Errorf("error writing provisioning journal %s: %w", j.path, err)
+	}
+	return nil
+}
+
+func (j *provisionJournal) done(step string) bool {
+	return contains(j.Steps, step)
+}
+
+// run prints message and runs f unless step already completed, and records
+// its completion along with anything f stored in the journal.
+func (j *provisionJournal) run(step string, message string, f func() error) error {
+	if j.done(step) {
+		fmt.Printf("%s (ALREADY DONE)\n", message)
+		return nil
+	}
+
+	fmt.Println(message)
+	if err := f(); err != nil {
+		return err
+	}
+	j.Steps = append(j.Steps, step)
+	return j.save()
+}
+
+// forget records that step and every step after it were undone, so that
+// resuming runs them again.
+func (j *provisionJournal) forget(step string) error {
+	for i, done := range j.Steps {
+		if done == step {
+			j.Steps = j.Steps[:i]
+			return j.save()
+		}
+	}
+	return nil
+}
+
+func (j *provisionJournal) remove() error {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,471 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewLocalStore returns a store backed by the directory at root. Bare git
+// repositories are committed to through git plumbing so they keep history,
+// any other directory is read and written in place.
+func NewLocalStore(root string, branch string) ConfigStore {
+	cmd := exec.Command("git", "-C", root, "rev-parse", "--is-bare-repository")
+	if output, err := cmd.Output(); err == nil && strings.TrimSpace(string(output)) == "true" {
+		return &gitRepoStore{root, branch}
+	}
+	return &dirStore{root}
+}
+
+type dirStore struct {
+	root string
+}
+
+func (s *dirStore) ReadFile(filePath string) (*File, error) {
+	content, err := ioutil.ReadFile(s.fullPath(filePath))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", filePath, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{path.Base(filePath), filePath, "file", blobSHA(content), content}, nil
+}
+
+func (s *dirStore) ListDir(dirPath string) ([]*File, error) {
+	infos, err := ioutil.ReadDir(s.fullPath(dirPath))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", dirPath, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*File
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		file := &File{Name: info.Name(), Path: path.Join(dirPath, info.Name()), Type: "file"}
+		if info.IsDir() {
+			file.Type = "dir"
+		} else {
+			content, err := ioutil.ReadFile(s.fullPath(file.Path))
+			if err != nil {
+				return nil, err
+			}
+			file.SHA = blobSHA(content)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func (s *dirStore) ReadFileAt(filePath string, commitSHA string) (*File, error) {
+	return nil, fmt.Errorf("history is not available for plain directory %s", s.root)
+}
+
+func (s *dirStore) ListDirAt(dirPath string, commitSHA string) ([]*File, error) {
+	return nil, fmt.Errorf("history is not available for plain directory %s", s.root)
+}
+
+func (s *dirStore) WriteFile(filePath string, content []byte, sha string, message string) (string, error) {
+	current, err := ioutil.ReadFile(s.fullPath(filePath))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if (err == nil && blobSHA(current) != sha) || (err != nil && sha != "") {
+		return "", fmt.Errorf("%s: %w", filePath, ErrConflict)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.fullPath(filePath)), os.ModePerm); err != nil {
+		return "", err
+	}
+	return "", ioutil.WriteFile(s.fullPath(filePath), content, 0644)
+}
+
+func (s *dirStore) Commit(message string, changes []FileChange) (string, error) {
+	for _, change := range changes {
+		if change.SHA == "" {
+			continue
+		}
+		if current, err := ioutil.ReadFile(s.fullPath(change.Path)); err != nil || blobSHA(current) != change.SHA {
+			return "", fmt.Errorf("%s changed: %w", change.Path, ErrConflict)
+		}
+	}
+	for _, change := range changes {
+		var err error
+		if change.Delete {
+			err = os.Remove(s.fullPath(change.Path))
+		} else if err = os.MkdirAll(filepath.Dir(s.fullPath(change.Path)), os.ModePerm); err == nil {
+			err = ioutil.WriteFile(s.fullPath(change.Path), change.Content, 0644)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+func (s *dirStore) History(filePath string) ([]Revision, error) {
+	return nil, fmt.Errorf("history is not available for plain directory %s", s.root)
+}
+
+func (s *dirStore) OpenPullRequest(branch string, title string, body string, changes []FileChange) (*PullRequest, error) {
+	return nil, fmt.Errorf("pull requests are not available for plain directory %s", s.root)
+}
+
+func (s *dirStore) GetPullRequest(number int) (*PullRequest, error) {
+	return nil, fmt.Errorf("pull requests are not available for plain directory %s", s.root)
+}
+
+func (s *dirStore) MergePullRequest(number int, headSHA string, message string) (string, error) {
+	return "", fmt.Errorf("pull requests are not available for plain directory %s", s.root)
+}
+
+func (s *dirStore) fullPath(filePath string) string {
+	return filepath.Join(s.root, filepath.FromSlash(filePath))
+}
+
+type gitRepoStore struct {
+	root   string
+	branch string
+}
+
+func (s *gitRepoStore) ReadFile(filePath string) (*File, error) {
+	return s.ReadFileAt(filePath, s.branch)
+}
+
+func (s *gitRepoStore) ReadFileAt(filePath string, ref string) (*File, error) {
+	sha, err := s.git(nil, nil, "rev-parse", "--verify", "--quiet", ref+":"+filePath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, ErrNotFound)
+	}
+	content, err := s.run(nil, nil, "cat-file", "blob", sha)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a file", filePath)
+	}
+
+	return &File{path.Base(filePath), filePath, "file", sha, content}, nil
+}
+
+func (s *gitRepoStore) ListDir(dirPath string) ([]*File, error) {
+	return s.ListDirAt(dirPath, s.branch)
+}
+
+func (s *gitRepoStore) ListDirAt(dirPath string, ref string) ([]*File, error) {
+	treeish := ref + ":" + strings.Trim(dirPath, "/")
+	if _, err := s.git(nil, nil, "rev-parse", "--verify", "--quiet", treeish); err != nil {
+		return nil, fmt.Errorf("/%s on %s: %w", strings.Trim(dirPath, "/"), ref, ErrNotFound)
+	}
+	output, err := s.git(nil, nil, "ls-tree", treeish)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*File
+	for _, line := range strings.Split(output, "\n") {
+		// <mode> SP <type> SP <sha> TAB <name>
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		meta := strings.Fields(fields[0])
+		file := &File{Name: fields[1], Path: path.Join(dirPath, fields[1]), Type: "file", SHA: meta[2]}
+		if meta[1] == "tree" {
+			file.Type = "dir"
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func (s *gitRepoStore) WriteFile(filePath string, content []byte, sha string, message string) (string, error) {
+	current, err := s.ReadFile(filePath)
+	if (err == nil && current.SHA != sha) || (err != nil && sha != "") {
+		return "", fmt.Errorf("%s: %w", filePath, ErrConflict)
+	}
+	return s.Commit(message, []FileChange{{Path: filePath, Content: content}})
+}
+
+func (s *gitRepoStore) Commit(message string, changes []FileChange) (string, error) {
+	parent, _ := s.git(nil, nil, "rev-parse", "--verify", "--quiet", "refs/heads/"+s.branch)
+	commitSHA, err := s.commitChanges(parent, message, changes)
+	if err != nil {
+		return "", err
+	}
+
+	// update-ref only moves the branch if it still points at parent
+	if _, err := s.git(nil, nil, "update-ref", "refs/heads/"+s.branch, commitSHA, parent); err != nil {
+		return "", fmt.Errorf("%s moved during commit: %w", s.branch, ErrConflict)
+	}
+	return commitSHA, nil
+}
+
+// commitChanges creates a commit applying changes on top of parent, which may
+// be empty for the first commit, without moving any branch.
+func (s *gitRepoStore) commitChanges(parent string, message string, changes []FileChange) (string, error) {
+	index, err := ioutil.TempFile("", "send-index")
+	if err != nil {
+		return "", err
+	}
+	index.Close()
+	os.Remove(index.Name())
+	defer os.Remove(index.Name())
+	env := []string{"GIT_INDEX_FILE=" + index.Name()}
+
+	if parent != "" {
+		if _, err := s.git(env, nil, "read-tree", parent); err != nil {
+			return "", err
+		}
+	}
+
+	for _, change := range changes {
+		if change.SHA != "" {
+			if current, _ := s.git(nil, nil, "rev-parse", "--verify", "--quiet", parent+":"+change.Path); current != change.SHA {
+				return "", fmt.Errorf("%s changed: %w", change.Path, ErrConflict)
+			}
+		}
+		if change.Delete {
+			// mode 0 removes the entry; --force-remove needs a work tree
+			_, err = s.git(env, []byte("0 "+strings.Repeat("0", 40)+"\t"+change.Path+"\n"), "update-index", "--index-info")
+		} else {
+			var blob string
+			if blob, err = s.git(nil, change.Content, "hash-object", "-w", "--stdin"); err == nil {
+				_, err = s.git(env, nil, "update-index", "--add", "--cacheinfo", "100644,"+blob+","+change.Path)
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	treeSHA, err := s.git(env, nil, "write-tree")
+	if err != nil {
+		return "", err
+	}
+	args := []string{"commit-tree", treeSHA, "-m", message}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	return s.git(nil, nil, args...)
+}
+
+// A bare repository has no pull requests, so they are emulated: the branch is
+// a regular branch and the pull request itself is a JSON blob referenced by
+// refs/reviews/<number>.
+type localPullRequest struct {
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+	Branch string `json:"branch"`
+	State  string `json:"state"`
+}
+
+func (s *gitRepoStore) OpenPullRequest(branch string, title string, body string, changes []FileChange) (*PullRequest, error) {
+	parent, err := s.git(nil, nil, "rev-parse", "--verify", "--quiet", "refs/heads/"+s.branch)
+	if err != nil {
+		return nil, fmt.Errorf("%s has no commits: %w", s.branch, ErrStoreFailure)
+	}
+	commitSHA, err := s.commitChanges(parent, title, changes)
+	if err != nil {
+		return nil, err
+	}
+	// An all-zero old value makes update-ref fail if the branch exists
+	if _, err := s.git(nil, nil, "update-ref", "refs/heads/"+branch, commitSHA, strings.Repeat("0", 40)); err != nil {
+		return nil, fmt.Errorf("branch %s already exists: %w", branch, ErrConflict)
+	}
+
+	refs, err := s.git(nil, nil, "for-each-ref", "--format=%(refname:lstrip=2)", "refs/reviews/")
+	if err != nil {
+		return nil, err
+	}
+	number := 1
+	for _, ref := range strings.Fields(refs) {
+		if n, err := strconv.Atoi(ref); err == nil && n >= number {
+			number = n + 1
+		}
+	}
+
+	if err := s.writePullRequest(number, localPullRequest{title, body, branch, "open"}, true); err != nil {
+		return nil, err
+	}
+	return &PullRequest{
+		Number:  number,
+		Title:   title,
+		Body:    body,
+		State:   "open",
+		Branch:  branch,
+		HeadSHA: commitSHA,
+		Changes: changes,
+	}, nil
+}
+
+func (s *gitRepoStore) GetPullRequest(number int) (*PullRequest, error) {
+	content, err := s.run(nil, nil, "cat-file", "blob", fmt.Sprintf("refs/reviews/%d", number))
+	if err != nil {
+		return nil, fmt.Errorf("pull request #%d: %w", number, ErrNotFound)
+	}
+	local := localPullRequest{}
+	if err := json.Unmarshal(content, &local); err != nil {
+		return nil, fmt.Errorf("error parsing pull request #%d: %w", number, err)
+	}
+
+	pr := &PullRequest{Number: number, Title: local.Title, Body: local.Body, State: local.State, Branch: local.Branch}
+	if local.State != "open" {
+		return pr, nil
+	}
+
+	if pr.HeadSHA, err = s.git(nil, nil, "rev-parse", "--verify", "--quiet", "refs/heads/"+local.Branch); err != nil {
+		return nil, fmt.Errorf("branch %s of pull request #%d: %w", local.Branch, number, ErrNotFound)
+	}
+	base, err := s.git(nil, nil, "merge-base", "refs/heads/"+s.branch, pr.HeadSHA)
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.git(nil, nil, "diff-tree", "-r", "--no-renames", "--name-status", base, pr.HeadSHA)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(output, "\n") {
+		// <status> TAB <path>
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) == 2 {
+			pr.Changes = append(pr.Changes, FileChange{Path: fields[1], Delete: fields[0] == "D"})
+		}
+	}
+	return pr, nil
+}
+
+func (s *gitRepoStore) MergePullRequest(number int, headSHA string, message string) (string, error) {
+	pr, err := s.GetPullRequest(number)
+	if err != nil {
+		return "", err
+	}
+	if pr.State != "open" {
+		return "", fmt.Errorf("pull request #%d is %s: %w", number, pr.State, ErrConflict)
+	}
+	if pr.HeadSHA != headSHA {
+		return "", fmt.Errorf("branch %s of pull request #%d changed: %w", pr.Branch, number, ErrConflict)
+	}
+
+	parent, err := s.git(nil, nil, "rev-parse", "--verify", "--quiet", "refs/heads/"+s.branch)
+	if err != nil {
+		return "", err
+	}
+	// merge-tree exits with status 1 if the merge has conflicts, other
+	// failures include git being older than 2.38, which added --write-tree
+	treeSHA, err := s.git(nil, nil, "merge-tree", "--write-tree", parent, headSHA)
+	var gitErr *gitError
+	if errors.As(err, &gitErr) && gitErr.status == 1 {
+		return "", fmt.Errorf("pull request #%d conflicts with %s: %w", number, s.branch, ErrConflict)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error merging pull request #%d, which needs git 2.38 or later: %w", number, err)
+	}
+	commitSHA, err := s.git(nil, nil, "commit-tree", treeSHA, "-m", message, "-p", parent, "-p", headSHA)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.git(nil, nil, "update-ref", "refs/heads/"+s.branch, commitSHA, parent); err != nil {
+		return "", fmt.Errorf("%s moved during merge: %w", s.branch, ErrConflict)
+	}
+
+	if err := s.writePullRequest(number, localPullRequest{pr.Title, pr.Body, pr.Branch, "merged"}, false); err != nil {
+		return "", err
+	}
+	s.git(nil, nil, "update-ref", "-d", "refs/heads/"+pr.Branch, headSHA)
+	return commitSHA, nil
+}
+
+func (s *gitRepoStore) writePullRequest(number int, pr localPullRequest, create bool) error {
+	content, _ := json.Marshal(pr)
+	blob, err := s.git(nil, content, "hash-object", "-w", "--stdin")
+	if err != nil {
+		return err
+	}
+
+	args := []string{"update-ref", fmt.Sprintf("refs/reviews/%d", number), blob}
+	if create {
+		args = append(args, strings.Repeat("0", 40))
+	}
+	if _, err := s.git(nil, nil, args...); err != nil {
+		return fmt.Errorf("pull request #%d: %w", number, ErrConflict)
+	}
+	return nil
+}
+
+func (s *gitRepoStore) History(filePath string) ([]Revision, error) {
+	output, err := s.git(nil, nil, "log", "--format=%H%x00%an%x00%aI%x00%B%x01", s.branch, "--", filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []Revision
+	for _, entry := range strings.Split(output, "\x01") {
+		fields := strings.SplitN(strings.TrimSpace(entry), "\x00", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		date, _ := time.Parse(time.RFC3339, fields[2])
+		revisions = append(revisions, Revision{fields[0], fields[1], strings.TrimSpace(fields[3]), date})
+	}
+	return revisions, nil
+}
+
+func (s *gitRepoStore) git(env []string, stdin []byte, args ...string) (string, error) {
+	output, err := s.run(env, stdin, args...)
+	return strings.TrimSpace(string(output)), err
+}
+
+func (s *gitRepoStore) run(env []string, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", s.root}, args...)...)
+	cmd.Env = append(os.Environ(), env...)
+	if os.Getenv("GIT_AUTHOR_NAME") == "" {
+		cmd.Env = append(cmd.Env, "GIT_AUTHOR_NAME=send", "GIT_AUTHOR_EMAIL=send@localhost")
+	}
+	if os.Getenv("GIT_COMMITTER_NAME") == "" {
+		cmd.Env = append(cmd.Env, "GIT_COMMITTER_NAME=send", "GIT_COMMITTER_EMAIL=send@localhost")
+	}
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		status := -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			status = exitErr.ExitCode()
+		}
+		return nil, &gitError{args[0], status, strings.TrimSpace(stderr.String())}
+	}
+	return output, nil
+}
+
+// gitError reports that a git command failed, with its exit status, or -1 if
+// it could not be run.
+type gitError struct {
+	command string
+	status  int
+	stderr  string
+}
+
+func (e *gitError) Error() string {
+	return fmt.Sprintf("git %s: %s: %s", e.command, e.stderr, ErrStoreFailure)
+}
+
+func (e *gitError) Unwrap() error {
+	return ErrStoreFailure
+}
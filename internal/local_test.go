@@ -0,0 +1,296 @@
+package internal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+// newTestRepoStore returns a store backed by a new, empty bare repository.
+func newTestRepoStore(t *testing.T) *gitRepoStore {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "send-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if output, err := exec.Command("git", "init", "--bare", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %s: %s", err, output)
+	}
+
+	store, ok := NewLocalStore(dir, "master").(*gitRepoStore)
+	if !ok {
+		t.Fatalf("NewLocalStore(%s) is not a git repository store", dir)
+	}
+	return store
+}
+
+func mustCommit(t *testing.T, store ConfigStore, message string, changes ...FileChange) string {
+	t.Helper()
+	sha, err := store.Commit(message, changes)
+	if err != nil {
+		t.Fatalf("Commit(%q): %v", message, err)
+	}
+	return sha
+}
+
+func readContent(t *testing.T, store ConfigStore, path string) string {
+	t.Helper()
+	file, err := store.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile(%s): %v", path, err)
+	}
+	return string(file.Content)
+}
+
+func TestGitRepoStoreWriteFile(t *testing.T) {
+	store := newTestRepoStore(t)
+
+	if _, err := store.ReadFile("users/alice.json"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("ReadFile of a missing file = %v, want ErrNotFound", err)
+	}
+	if _, err := store.WriteFile("users/alice.json", []byte("v1"), "", "Add alice"); err != nil {
+		t.Fatal(err)
+	}
+	file, err := store.ReadFile("users/alice.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(file.Content) != "v1" || file.SHA != blobSHA([]byte("v1")) {
+		t.Errorf("ReadFile = %q with SHA %s, want v1 with SHA %s", file.Content, file.SHA, blobSHA([]byte("v1")))
+	}
+
+	if _, err := store.WriteFile("users/alice.json", []byte("v2"), "", "Recreate alice"); !errors.Is(err, ErrConflict) {
+		t.Errorf("WriteFile of an existing file without its SHA = %v, want ErrConflict", err)
+	}
+	if _, err := store.WriteFile("users/alice.json", []byte("v2"), file.SHA, "Update alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteFile("users/alice.json", []byte("v3"), file.SHA, "Update alice again"); !errors.Is(err, ErrConflict) {
+		t.Errorf("WriteFile with a stale SHA = %v, want ErrConflict", err)
+	}
+	if got := readContent(t, store, "users/alice.json"); got != "v2" {
+		t.Errorf("content = %q, want v2", got)
+	}
+}
+
+func TestGitRepoStoreCommit(t *testing.T) {
+	store := newTestRepoStore(t)
+
+	first := mustCommit(t, store, "Add app",
+		FileChange{Path: "app/hosts", Content: []byte("[manager]\n1.2.3.4")},
+		FileChange{Path: "app/docker-compose/web.yml", Content: []byte("web: 1")},
+		FileChange{Path: "app/docker-compose/db.yml", Content: []byte("db: 1")},
+	)
+	second := mustCommit(t, store, "Update web and remove db",
+		FileChange{Path: "app/docker-compose/web.yml", Content: []byte("web: 2")},
+		FileChange{Path: "app/docker-compose/db.yml", Delete: true},
+	)
+
+	entries, err := store.ListDir("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, entry := range entries {
+		listed = append(listed, entry.Path+" "+entry.Type)
+	}
+	if want := []string{"app/docker-compose dir", "app/hosts file"}; !reflect.DeepEqual(listed, want) {
+		t.Errorf("ListDir(app) = %v, want %v", listed, want)
+	}
+	if _, err := store.ListDir("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ListDir of a missing directory = %v, want ErrNotFound", err)
+	}
+
+	if got := readContent(t, store, "app/docker-compose/web.yml"); got != "web: 2" {
+		t.Errorf("web.yml = %q, want web: 2", got)
+	}
+	if _, err := store.ReadFile("app/docker-compose/db.yml"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ReadFile of a deleted file = %v, want ErrNotFound", err)
+	}
+
+	old, err := store.ReadFileAt("app/docker-compose/db.yml", first)
+	if err != nil || string(old.Content) != "db: 1" {
+		t.Errorf("ReadFileAt(db.yml, first) = %v, %v, want db: 1", old, err)
+	}
+	oldEntries, err := store.ListDirAt("app/docker-compose", first)
+	if err != nil || len(oldEntries) != 2 {
+		t.Errorf("ListDirAt(docker-compose, first) = %d entries, %v, want 2", len(oldEntries), err)
+	}
+
+	history, err := store.History("app/docker-compose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shas, messages []string
+	for _, revision := range history {
+		shas = append(shas, revision.SHA)
+		messages = append(messages, revision.Message)
+	}
+	if want := []string{second, first}; !reflect.DeepEqual(shas, want) {
+		t.Errorf("History SHAs = %v, want %v", shas, want)
+	}
+	if want := []string{"Update web and remove db", "Add app"}; !reflect.DeepEqual(messages, want) {
+		t.Errorf("History messages = %v, want %v", messages, want)
+	}
+	if history, err := store.History("app/hosts"); err != nil || len(history) != 1 {
+		t.Errorf("History(app/hosts) = %d revisions, %v, want 1", len(history), err)
+	}
+}
+
+func TestGitRepoStoreCommitChecksSHA(t *testing.T) {
+	store := newTestRepoStore(t)
+	mustCommit(t, store, "Add alice", FileChange{Path: "users/alice.json", Content: []byte("v1")})
+	stale := blobSHA([]byte("v1"))
+	head := mustCommit(t, store, "Update alice", FileChange{Path: "users/alice.json", Content: []byte("v2")})
+
+	tests := []struct {
+		name   string
+		change FileChange
+	}{
+		{"stale update", FileChange{Path: "users/alice.json", Content: []byte("v3"), SHA: stale}},
+		{"stale delete", FileChange{Path: "users/alice.json", Delete: true, SHA: stale}},
+		{"missing file", FileChange{Path: "users/bob.json", Content: []byte("v1"), SHA: stale}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := store.Commit(test.name, []FileChange{test.change}); !errors.Is(err, ErrConflict) {
+				t.Errorf("Commit = %v, want ErrConflict", err)
+			}
+			if current, _ := store.git(nil, nil, "rev-parse", "refs/heads/master"); current != head {
+				t.Errorf("master moved to %s after a conflict", current)
+			}
+		})
+	}
+
+	mustCommit(t, store, "Update alice with SHA", FileChange{Path: "users/alice.json", Content: []byte("v3"), SHA: blobSHA([]byte("v2"))})
+	if got := readContent(t, store, "users/alice.json"); got != "v3" {
+		t.Errorf("content = %q, want v3", got)
+	}
+}
+
+func TestGitRepoStorePullRequests(t *testing.T) {
+	store := newTestRepoStore(t)
+	mustCommit(t, store, "Add app",
+		FileChange{Path: "app/docker-compose/web.yml", Content: []byte("web: 1")},
+		FileChange{Path: "app/docker-compose/db.yml", Content: []byte("db: 1")},
+	)
+
+	pr, err := store.OpenPullRequest("send/app/alice-1", "Update web", "Please review", []FileChange{
+		{Path: "app/docker-compose/web.yml", Content: []byte("web: 2")},
+		{Path: "app/docker-compose/db.yml", Delete: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.Number != 1 || pr.State != "open" {
+		t.Errorf("OpenPullRequest = #%d %s, want #1 open", pr.Number, pr.State)
+	}
+	if _, err := store.OpenPullRequest("send/app/alice-1", "Again", "", nil); !errors.Is(err, ErrConflict) {
+		t.Errorf("OpenPullRequest on an existing branch = %v, want ErrConflict", err)
+	}
+	if got := readContent(t, store, "app/docker-compose/web.yml"); got != "web: 1" {
+		t.Errorf("opening a pull request changed master: web.yml = %q", got)
+	}
+
+	// master moves on without touching the pull request's files
+	mustCommit(t, store, "Add hosts", FileChange{Path: "app/hosts", Content: []byte("[manager]\n1.2.3.4")})
+
+	fetched, err := store.GetPullRequest(pr.Number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantChanges := []FileChange{{Path: "app/docker-compose/db.yml", Delete: true}, {Path: "app/docker-compose/web.yml"}}
+	if fetched.HeadSHA != pr.HeadSHA || fetched.Title != "Update web" || !reflect.DeepEqual(fetched.Changes, wantChanges) {
+		t.Errorf("GetPullRequest = %+v, want head %s and changes %+v", fetched, pr.HeadSHA, wantChanges)
+	}
+	if _, err := store.GetPullRequest(2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetPullRequest of a missing pull request = %v, want ErrNotFound", err)
+	}
+
+	if _, err := store.MergePullRequest(pr.Number, "0000000", "Merge"); !errors.Is(err, ErrConflict) {
+		t.Errorf("MergePullRequest with a stale head = %v, want ErrConflict", err)
+	}
+	if _, err := store.MergePullRequest(pr.Number, pr.HeadSHA, "Merge #1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readContent(t, store, "app/docker-compose/web.yml"); got != "web: 2" {
+		t.Errorf("web.yml after merge = %q, want web: 2", got)
+	}
+	if _, err := store.ReadFile("app/docker-compose/db.yml"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("db.yml after merge = %v, want ErrNotFound", err)
+	}
+	if got := readContent(t, store, "app/hosts"); got != "[manager]\n1.2.3.4" {
+		t.Errorf("merge lost the commit on master: hosts = %q", got)
+	}
+
+	merged, err := store.GetPullRequest(pr.Number)
+	if err != nil || merged.State != "merged" {
+		t.Errorf("GetPullRequest after merge = %+v, %v, want merged", merged, err)
+	}
+	if _, err := store.MergePullRequest(pr.Number, pr.HeadSHA, "Merge #1 again"); !errors.Is(err, ErrConflict) {
+		t.Errorf("merging a merged pull request = %v, want ErrConflict", err)
+	}
+}
+
+func TestGitRepoStoreConflictingPullRequest(t *testing.T) {
+	store := newTestRepoStore(t)
+	mustCommit(t, store, "Add web", FileChange{Path: "app/docker-compose/web.yml", Content: []byte("web: 1\n")})
+
+	pr, err := store.OpenPullRequest("send/app/alice-1", "Update web", "", []FileChange{
+		{Path: "app/docker-compose/web.yml", Content: []byte("web: 2\n")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustCommit(t, store, "Update web directly", FileChange{Path: "app/docker-compose/web.yml", Content: []byte("web: 3\n")})
+
+	if _, err := store.MergePullRequest(pr.Number, pr.HeadSHA, "Merge #1"); !errors.Is(err, ErrConflict) {
+		t.Errorf("MergePullRequest of a conflicting change = %v, want ErrConflict", err)
+	}
+	if got := readContent(t, store, "app/docker-compose/web.yml"); got != "web: 3\n" {
+		t.Errorf("web.yml = %q, want web: 3", got)
+	}
+	if open, err := store.GetPullRequest(pr.Number); err != nil || open.State != "open" {
+		t.Errorf("GetPullRequest after a failed merge = %+v, %v, want open", open, err)
+	}
+}
+
+func TestGitRepoStoreMergeConflict(t *testing.T) {
+	store := newTestRepoStore(t)
+	mustCommit(t, store, "Add web", FileChange{Path: "app/docker-compose/web.yml", Content: []byte("web: 1")})
+
+	pr, err := store.OpenPullRequest("send/app/alice-1", "Update web", "", []FileChange{
+		{Path: "app/docker-compose/web.yml", Content: []byte("web: 2")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustCommit(t, store, "Bob updates web", FileChange{Path: "app/docker-compose/web.yml", Content: []byte("web: 3")})
+
+	_, err = store.MergePullRequest(pr.Number, pr.HeadSHA, "Merge #1")
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("MergePullRequest of a conflicting pull request = %v, want ErrConflict", err)
+	}
+	if got := readContent(t, store, "app/docker-compose/web.yml"); got != "web: 3" {
+		t.Errorf("web.yml after a conflicting merge = %q, want web: 3", got)
+	}
+}
+
+func TestGitErrorStatus(t *testing.T) {
+	store := newTestRepoStore(t)
+	_, err := store.git(nil, nil, "merge-tree", "--no-such-option")
+	var gitErr *gitError
+	if !errors.As(err, &gitErr) || gitErr.status == 0 || gitErr.status == 1 {
+		t.Errorf("git with an unknown option = %#v, want a status other than 0 or 1", err)
+	}
+	if !errors.Is(err, ErrStoreFailure) {
+		t.Errorf("git with an unknown option = %v, want ErrStoreFailure", err)
+	}
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+type LogOptions struct {
+	Follow bool
+	Since  string
+	Tail   string
+}
+
+// StreamLogs copies the logs of the given services of an app to stdout as
+// they are produced, or of every service in its stack if none are given.
+// With more than one service, each line is prefixed with its service name.
+func StreamLogs(app string, services []string, options LogOptions) error {
+	client, err := connectToApp(app)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	available, err := getServices(client, app)
+	if err != nil {
+		return err
+	}
+	if len(available) == 0 {
+		return fmt.Errorf("%s has no services deployed: %w", app, ErrNotFound)
+	}
+	if len(services) == 0 {
+		services = available
+	}
+	for _, service := range services {
+		if !contains(available, service) {
+			return fmt.Errorf("%s has no service %q, its services are %s: %w", app, service, strings.Join(available, ", "), ErrNotFound)
+		}
+	}
+
+	width := 0
+	for _, service := range services {
+		if len(service) > width {
+			width = len(service)
+		}
+	}
+
+	var outputMutex sync.Mutex
+	errs := make(chan error, len(services))
+	for _, service := range services {
+		prefix := ""
+		if len(services) > 1 {
+			prefix = fmt.Sprintf("%-*s | ", width, service)
+		}
+		stdout := &prefixWriter{prefix: prefix, out: os.Stdout, mutex: &outputMutex}
+		stderr := &prefixWriter{prefix: prefix, out: os.Stderr, mutex: &outputMutex}
+
+		go func(service string) {
+			command := logsCommand(stackName(app)+"_"+service, options)
+			status, err := client.RunStreaming(command, stdout, stderr)
+			stdout.Flush()
+			stderr.Flush()
+			if err == nil && status != 0 {
+				err = fmt.Errorf("docker service logs for %s exited with status %d: %w", service, status, ErrRemoteFailure)
+			}
+			errs <- err
+		}(service)
+	}
+
+	var firstErr error
+	for range services {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func logsCommand(service string, options LogOptions) string {
+	command := "docker service logs"
+	if options.Follow {
+		command += " --follow"
+	}
+	if options.Since != "" {
+		command += " --since " + shellQuote(options.Since)
+	}
+	if options.Tail != "" {
+		command += " --tail " + shellQuote(options.Tail)
+	}
+	return command + " " + shellQuote(service)
+}
+
+// prefixWriter writes whole lines to out with prefix in front of each, so
+// lines from several writers sharing a mutex never interleave.
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+	mutex  *sync.Mutex
+	buffer []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+	end := bytes.LastIndexByte(w.buffer, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+
+	lines := w.buffer[:end+1]
+	w.buffer = append([]byte(nil), w.buffer[end+1:]...)
+	return len(p), w.write(lines)
+}
+
+// Flush writes a final line that did not end in a newline.
+func (w *prefixWriter) Flush() error {
+	if len(w.buffer) == 0 {
+		return nil
+	}
+	lines := append(w.buffer, '\n')
+	w.buffer = nil
+	return w.write(lines)
+}
+
+func (w *prefixWriter) write(lines []byte) error {
+	var prefixed bytes.Buffer
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) > 0 {
+			prefixed.WriteString(w.prefix)
+			prefixed.Write(line)
+		}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err := w.out.Write(prefixed.Bytes())
+	return err
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// notificationsPath is the file in the devops repo that decides where
+// notifications about each app are sent.
+const notificationsPath = "notifications.json"
+
+type Notification struct {
+	Text string `json:"text"`
+	User string `json:"user,omitempty"`
+	App  string `json:"app,omitempty"`
+}
+
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+type notifierConfig struct {
+	Type        string   `json:"type"`
+	URL         string   `json:"url"`
+	Channel     string   `json:"channel"`
+	Host        string   `json:"host"`
+	From        string   `json:"from"`
+	To          []string `json:"to"`
+	Username    string   `json:"username"`
+	PasswordEnv string   `json:"password_env"`
+}
+
+type notificationRoutes struct {
+	Default []notifierConfig            `json:"default"`
+	Apps    map[string][]notifierConfig `json:"apps"`
+}
+
+func newNotifier(c notifierConfig) (Notifier, error) {
+	switch c.Type {
+	case "slack":
+		return &slackNotifier{c.URL, c.Channel}, nil
+	case "webhook":
+		return &webhookNotifier{c.URL}, nil
+	case "smtp":
+		return &smtpNotifier{c.Host, c.From, c.To, c.Username, os.Getenv(c.PasswordEnv)}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier type %q in %s", c.Type, notificationsPath)
+}
+
+// getNotifiers returns the notifiers configured for app in the devops repo,
+// falling back to the default ones. Without any configuration, notifications
+// go to the Slack webhook in SEND_UPDATES_HOOK_URL.
+func getNotifiers(app string) ([]Notifier, error) {
+	routes := notificationRoutes{}
+	file, err := getStore().ReadFile(notificationsPath)
+	if errors.Is(err, ErrNotFound) {
+		if hookURL := os.Getenv("SEND_UPDATES_HOOK_URL"); hookURL != "" {
+			return []Notifier{&slackNotifier{hookURL, ""}}, nil
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(file.Content, &routes); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", notificationsPath, err)
+	}
+
+	configs, ok := routes.Apps[app]
+	if !ok {
+		configs = routes.Default
+	}
+
+	var notifiers []Notifier
+	for _, c := range configs {
+		notifier, err := newNotifier(c)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	return notifiers, nil
+}
+
+// Notify sends n to every notifier routed to its app and reports all that
+// failed.
+func Notify(n Notification) error {
+	notifiers, err := getNotifiers(n.App)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for _, notifier := range notifiers {
+		if err := notifier.Notify(n); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("error occurred sending notification: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func postJSON(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+type webhookNotifier struct {
+	url string
+}
+
+func (w *webhookNotifier) Notify(n Notification) error {
+	return postJSON(w.url, struct {
+		Notification
+		Time time.Time `json:"time"`
+	}{n, time.Now().UTC()})
+}
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+var defaultArgon2Params = argon2Params{64 * 1024, 3, 2}
+
+func checkPasswordPolicy(username string, password []byte) error {
+	if len(password) < config.MinPasswordLength {
+		return fmt.Errorf("your password must be at least %d characters: %w", config.MinPasswordLength, ErrInvalidInput)
+	}
+	if username != "" && strings.Contains(strings.ToLower(string(password)), strings.ToLower(username)) {
+		return fmt.Errorf("your password cannot contain your username: %w", ErrInvalidInput)
+	}
+	return nil
+}
+
+func hashPassword(password []byte) (string, error) {
+	if config.PasswordHash == "argon2id" {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		p := defaultArgon2Params
+		key := argon2.IDKey(password, salt, p.time, p.memory, p.threads, 32)
+
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.time, p.threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword(password, config.BcryptCost)
+	return string(hash), err
+}
+
+// parseArgon2Hash splits a hash in the PHC string format produced by
+// hashPassword into its parameters, salt and key.
+func parseArgon2Hash(hash string) (argon2Params, []byte, []byte, error) {
+	var p argon2Params
+	var version int
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	return p, salt, key, err
+}
+
+func comparePassword(hash string, password []byte) error {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), password)
+	}
+
+	p, salt, key, err := parseArgon2Hash(hash)
+	if err != nil {
+		return err
+	}
+	computed := argon2.IDKey(password, salt, p.time, p.memory, p.threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+	return nil
+}
+
+// needsRehash reports whether hash is weaker than what hashPassword would
+// produce with the current configuration.
+func needsRehash(hash string) bool {
+	if config.PasswordHash == "argon2id" {
+		p, _, _, err := parseArgon2Hash(hash)
+		return err != nil || p.memory < defaultArgon2Params.memory || p.time < defaultArgon2Params.time
+	}
+	if strings.HasPrefix(hash, "$argon2id$") {
+		// Never downgrade from argon2id to bcrypt
+		return false
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < config.BcryptCost
+}
+
+// rehashPassword upgrades the stored hash of a user who just logged in with
+// password. The write is skipped if the hash changed in the meantime.
+func rehashPassword(u user, password []byte) (user, error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return u, err
+	}
+
+	updated := u
+	err = updateUser(u.Username, "Upgrade password hash for "+u.Username, func(user *user) error {
+		if user.HashedPassword != u.HashedPassword {
+			return errUnchanged
+		}
+		user.HashedPassword = hash
+		updated = *user
+		return nil
+	})
+	if err != nil {
+		return u, err
+	}
+	return updated, nil
+}
+
+func SetPassword(username string, hash string) (user, error) {
+	var updated user
+	err := updateUser(username, "Change password for "+username, func(user *user) error {
+		user.HashedPassword = hash
+		user.ResetCode = ""
+		user.ResetExpiresAt = 0
+		updated = *user
+		return nil
+	})
+	return updated, err
+}
+
+// IssueResetCode stores a hashed one-time code for the user that can be used
+// in place of their password once before ttl passes.
+func IssueResetCode(username string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", fmt.Errorf("reset code ttl must be positive: %w", ErrInvalidInput)
+	}
+
+	codeBytes := make([]byte, 10)
+	if _, err := rand.Read(codeBytes); err != nil {
+		return "", err
+	}
+	code := base32.StdEncoding.EncodeToString(codeBytes)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	err = updateUser(username, "Issue password reset code for "+username, func(user *user) error {
+		user.ResetCode = string(hash)
+		user.ResetExpiresAt = time.Now().Add(ttl).Unix()
+		return nil
+	})
+	return code, err
+}
+
+func checkResetCode(user user, code []byte) error {
+	if user.ResetCode == "" || user.ResetExpiresAt < time.Now().Unix() {
+		return ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.ResetCode), code) != nil {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func VerifyResetCode(username string, code []byte) error {
+	user, err := GetUser(username)
+	if err != nil {
+		return ErrInvalidCredentials
+	}
+	return checkResetCode(user, code)
+}
+
+// RedeemResetCode replaces the user's password if code is still valid. The
+// code is cleared in the same SHA-checked write, so it can only be used once.
+func RedeemResetCode(username string, code []byte, hash string) (user, error) {
+	var updated user
+	err := updateUser(username, "Reset password for "+username, func(user *user) error {
+		if err := checkResetCode(*user, code); err != nil {
+			return err
+		}
+
+		user.HashedPassword = hash
+		user.ResetCode = ""
+		user.ResetExpiresAt = 0
+		updated = *user
+		return nil
+	})
+	return updated, err
+}
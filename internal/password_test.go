@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// withConfig runs f with the package configuration changed by update.
+func withConfig(t *testing.T, update func(*Config), f func()) {
+	t.Helper()
+	saved := config
+	defer func() { config = saved }()
+	update(&config)
+	f()
+}
+
+func TestParseArgon2Hash(t *testing.T) {
+	tests := []struct {
+		name    string
+		hash    string
+		want    argon2Params
+		wantErr bool
+	}{
+		{"valid", "$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHQ$a2V5a2V5", argon2Params{65536, 3, 2}, false},
+		{"other params", "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5", argon2Params{1024, 1, 1}, false},
+		{"bcrypt", "$2a$10$abcdefghijklmnopqrstuuABCDEFGHIJKLMNOPQRSTUVWXYZ01234", argon2Params{}, true},
+		{"argon2i", "$argon2i$v=19$m=65536,t=3,p=2$c2FsdHNhbHQ$a2V5a2V5", argon2Params{}, true},
+		{"old version", "$argon2id$v=16$m=65536,t=3,p=2$c2FsdHNhbHQ$a2V5a2V5", argon2Params{}, true},
+		{"bad params", "$argon2id$v=19$m=x,t=3,p=2$c2FsdHNhbHQ$a2V5a2V5", argon2Params{}, true},
+		{"bad salt", "$argon2id$v=19$m=65536,t=3,p=2$!!$a2V5a2V5", argon2Params{}, true},
+		{"missing key", "$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHQ", argon2Params{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, salt, key, err := parseArgon2Hash(test.hash)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parseArgon2Hash(%q) succeeded, want an error", test.hash)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseArgon2Hash(%q): %v", test.hash, err)
+			}
+			if p != test.want || string(salt) != "saltsalt" || string(key) != "keykey" {
+				t.Errorf("parseArgon2Hash(%q) = %+v, %q, %q", test.hash, p, salt, key)
+			}
+		})
+	}
+}
+
+func TestHashAndComparePassword(t *testing.T) {
+	for _, algorithm := range []string{"bcrypt", "argon2id"} {
+		t.Run(algorithm, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.PasswordHash = algorithm
+				c.BcryptCost = bcrypt.MinCost
+			}, func() {
+				hash, err := hashPassword([]byte("correct horse"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if algorithm == "argon2id" && !strings.HasPrefix(hash, "$argon2id$") {
+					t.Errorf("hash %q is not argon2id", hash)
+				}
+				if err := comparePassword(hash, []byte("correct horse")); err != nil {
+					t.Errorf("comparePassword with the right password: %v", err)
+				}
+				if err := comparePassword(hash, []byte("wrong horse")); err == nil {
+					t.Error("comparePassword with the wrong password succeeded")
+				}
+			})
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	weakBcrypt, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	strongBcrypt, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost+2)
+	weakArgon2 := "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5"
+	strongArgon2 := "$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHQ$a2V5a2V5"
+
+	tests := []struct {
+		name      string
+		algorithm string
+		hash      string
+		want      bool
+	}{
+		{"bcrypt below cost", "bcrypt", string(weakBcrypt), true},
+		{"bcrypt at cost", "bcrypt", string(strongBcrypt), false},
+		{"argon2id never downgraded", "bcrypt", weakArgon2, false},
+		{"invalid bcrypt", "bcrypt", "not a hash", true},
+		{"bcrypt upgraded", "argon2id", string(strongBcrypt), true},
+		{"weak argon2id", "argon2id", weakArgon2, true},
+		{"default argon2id", "argon2id", strongArgon2, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.PasswordHash = test.algorithm
+				c.BcryptCost = bcrypt.MinCost + 1
+			}, func() {
+				if got := needsRehash(test.hash); got != test.want {
+					t.Errorf("needsRehash(%q) = %v, want %v", test.hash, got, test.want)
+				}
+			})
+		})
+	}
+}
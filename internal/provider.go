@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const ServerActive = "active"
+
+// Region features that server options depend on
+const (
+	FeatureIPv6       = "ipv6"
+	FeatureBackups    = "backups"
+	FeatureMonitoring = "monitoring"
+)
+
+type Server struct {
+	ID     string
+	Status string
+	IP     string
+}
+
+// ServerOptions describe the server to create. They are recorded in the
+// app's metadata.
+type ServerOptions struct {
+	Size       string   `json:"size"`
+	Region     string   `json:"region,omitempty"`
+	Image      string   `json:"image,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	VPC        string   `json:"vpc,omitempty"`
+	IPv6       bool     `json:"ipv6,omitempty"`
+	Monitoring bool     `json:"monitoring,omitempty"`
+	Backups    bool     `json:"backups,omitempty"`
+}
+
+type Size struct {
+	Slug   string
+	Memory int
+	Vcpus  int
+	Disk   int
+}
+
+type Region struct {
+	Slug     string
+	Name     string
+	Features []string
+}
+
+type VPC struct {
+	ID     string
+	Name   string
+	Region string
+}
+
+// CloudProvider creates and manages the servers apps run on. Providers that
+// have no choice of sizes, regions, images or VPCs list none, and then accept
+// any value for them.
+type CloudProvider interface {
+	// Name identifies the provider in app metadata.
+	Name() string
+	// RegisterKey makes an SSH public key available to new servers and
+	// returns its ID.
+	RegisterKey(name string, publicKey []byte) (string, error)
+	DeleteKey(keyID string) error
+	// CreateServer starts creating a server that accepts the key with keyID
+	// and returns the server's ID. The server is ready once its status is
+	// ServerActive and it has an IP.
+	CreateServer(name string, options ServerOptions, keyID string) (string, error)
+	GetServer(serverID string) (*Server, error)
+	DestroyServer(serverID string) error
+	// DefaultServerOptions fills in the options that were not chosen.
+	DefaultServerOptions(options ServerOptions) ServerOptions
+	ListRegions() ([]Region, error)
+	// ListSizes and ListImages return what is available in region.
+	ListSizes(region string) ([]Size, error)
+	ListImages(region string) ([]string, error)
+	ListVPCs() ([]VPC, error)
+}
+
+// NewCloudProvider returns the provider called name. ip is the address of
+// the server for the existing provider, and optionally of the pretend server
+// for the fake one.
+func NewCloudProvider(name string, ip string) (CloudProvider, error) {
+	switch name {
+	case "digitalocean":
+		token := os.Getenv("DO_ACCESS_TOKEN")
+		if token == "" {
+			return nil, fmt.Errorf("DO_ACCESS_TOKEN is not set: %w", ErrInvalidInput)
+		}
+		return newDigitalOceanProvider(token), nil
+	case "fake":
+		if ip == "" {
+			ip = "127.0.0.1"
+		}
+		return newFakeProvider(ip), nil
+	case "existing":
+		return newExistingProvider(ip), nil
+	}
+	return nil, fmt.Errorf("unknown provider %q, valid providers are digitalocean, fake and existing: %w", name, ErrInvalidInput)
+}
+
+var tagPattern = regexp.MustCompile(`^[a-zA-Z0-9_:-]{1,255}$`)
+
+// ValidateServerOptions fills in the provider's defaults and checks the
+// options against what the provider offers. A VPC may be given by name, it
+// is replaced by its ID.
+func ValidateServerOptions(provider CloudProvider, options ServerOptions) (ServerOptions, error) {
+	options = provider.DefaultServerOptions(options)
+
+	for _, tag := range options.Tags {
+		if !tagPattern.MatchString(tag) {
+			return options, fmt.Errorf("invalid tag %q, tags may only contain letters, numbers, colons, dashes and underscores: %w", tag, ErrInvalidInput)
+		}
+	}
+
+	regions, err := provider.ListRegions()
+	if err != nil {
+		return options, err
+	}
+	if len(regions) > 0 {
+		var region *Region
+		var slugs []string
+		for i := range regions {
+			slugs = append(slugs, regions[i].Slug)
+			if regions[i].Slug == options.Region {
+				region = &regions[i]
+			}
+		}
+		if region == nil {
+			return options, fmt.Errorf("unknown region %q, valid regions are %s: %w", options.Region, strings.Join(slugs, ", "), ErrInvalidInput)
+		}
+
+		wanted := []struct {
+			feature string
+			enabled bool
+		}{{FeatureIPv6, options.IPv6}, {FeatureBackups, options.Backups}, {FeatureMonitoring, options.Monitoring}}
+		for _, w := range wanted {
+			if w.enabled && !contains(region.Features, w.feature) {
+				return options, fmt.Errorf("region %s does not support %s: %w", region.Slug, w.feature, ErrInvalidInput)
+			}
+		}
+	}
+
+	sizes, err := provider.ListSizes(options.Region)
+	if err != nil {
+		return options, err
+	}
+	if len(sizes) > 0 {
+		valid := false
+		for _, size := range sizes {
+			valid = valid || size.Slug == options.Size
+		}
+		if !valid {
+			return options, fmt.Errorf("size %q is not available in %s, see send sizes for valid sizes: %w", options.Size, options.Region, ErrInvalidInput)
+		}
+	}
+
+	images, err := provider.ListImages(options.Region)
+	if err != nil {
+		return options, err
+	}
+	if len(images) > 0 && !contains(images, options.Image) {
+		return options, fmt.Errorf("unknown image %q in %s, valid images are %s: %w", options.Image, options.Region, strings.Join(images, ", "), ErrInvalidInput)
+	}
+
+	if options.VPC != "" {
+		vpcs, err := provider.ListVPCs()
+		if err != nil {
+			return options, err
+		}
+		if len(vpcs) > 0 {
+			var names []string
+			found := false
+			for _, vpc := range vpcs {
+				if vpc.Region != options.Region {
+					continue
+				}
+				names = append(names, vpc.Name)
+				if vpc.ID == options.VPC || vpc.Name == options.VPC {
+					options.VPC = vpc.ID
+					found = true
+					break
+				}
+			}
+			if !found {
+				return options, fmt.Errorf("unknown VPC %q in %s, valid VPCs are %s: %w", options.VPC, options.Region, strings.Join(names, ", "), ErrInvalidInput)
+			}
+		}
+	}
+	return options, nil
+}
+
+func GetValidSizeStrings(provider CloudProvider, region string) ([]string, error) {
+	if region == "" {
+		region = provider.DefaultServerOptions(ServerOptions{}).Region
+	}
+	sizes, err := provider.ListSizes(region)
+	if err != nil {
+		return nil, err
+	}
+
+	var strs []string
+	for _, size := range sizes {
+		strs = append(strs, fmt.Sprintf("%s \t Memory: %d, Vcpus: %d, Disk: %d", size.Slug, size.Memory, size.Vcpus, size.Disk))
+	}
+	return strs, nil
+}
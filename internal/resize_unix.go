@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package internal
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchWindowSize calls f whenever the local terminal is resized until the
+// returned function is called.
+func watchWindowSize(f func()) (stop func()) {
+	resized := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(resized, syscall.SIGWINCH)
+
+	go func() {
+		for {
+			select {
+			case <-resized:
+				f()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(resized)
+		close(done)
+	}
+}
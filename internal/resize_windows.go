@@ -0,0 +1,6 @@
+package internal
+
+// watchWindowSize does nothing on Windows, which has no resize signal.
+func watchWindowSize(f func()) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	RoleViewer   = "viewer"
+	RoleDeployer = "deployer"
+	RoleAppAdmin = "app-admin"
+)
+
+type Permission string
+
+const (
+	PermReadConfig  Permission = "read config"
+	PermReadLogs    Permission = "read logs"
+	PermPushConfig  Permission = "push config"
+	PermDeploy      Permission = "deploy"
+	PermExec        Permission = "exec"
+	PermGrantAccess Permission = "grant access"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleViewer:   {PermReadConfig, PermReadLogs},
+	RoleDeployer: {PermReadConfig, PermReadLogs, PermPushConfig, PermDeploy, PermExec},
+	RoleAppAdmin: {PermReadConfig, PermReadLogs, PermPushConfig, PermDeploy, PermExec, PermGrantAccess},
+}
+
+// userSchemaVersion is bumped whenever the layout of users/<name>.json changes.
+// Version 2 replaced the flat apps list with per-app roles.
+const userSchemaVersion = 2
+
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func GetRoles() []string {
+	return []string{RoleViewer, RoleDeployer, RoleAppAdmin}
+}
+
+func (u user) HasPermission(app string, permission Permission) bool {
+	if u.IsAdmin {
+		return true
+	}
+	for _, p := range rolePermissions[u.Roles[app]] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// AppRoles returns the user's apps with their roles, sorted by app name.
+func (u user) AppRoles() []string {
+	var apps []string
+	for app, role := range u.Roles {
+		apps = append(apps, fmt.Sprintf("%s (%s)", app, role))
+	}
+	sort.Strings(apps)
+	return apps
+}
+
+// migrateUser upgrades a user read from an older schema in place and reports
+// whether anything changed. Users that had access to an app before roles
+// existed could pull, push and exec, so they become deployers.
+func migrateUser(u *user) bool {
+	if u.SchemaVersion >= userSchemaVersion {
+		return false
+	}
+
+	if u.Roles == nil {
+		u.Roles = map[string]string{}
+	}
+	for _, app := range u.Apps {
+		if _, ok := u.Roles[app]; !ok {
+			u.Roles[app] = RoleDeployer
+		}
+	}
+	u.Apps = nil
+	u.SchemaVersion = userSchemaVersion
+	return true
+}
+
+func HasPermission(username string, app string, permission Permission) (bool, error) {
+	user, err := GetUser(username)
+	if err != nil {
+		return false, err
+	}
+
+	return user.HasPermission(app, permission), nil
+}
+
+func GrantRole(username string, app string, role string) error {
+	if !IsValidRole(role) {
+		return fmt.Errorf("unknown role %q, valid roles are %s: %w", role, strings.Join(GetRoles(), ", "), ErrInvalidInput)
+	}
+	apps, err := GetApps()
+	if err != nil {
+		return err
+	}
+	if !contains(apps, app) {
+		return fmt.Errorf("%s: %w", app, ErrAppNotFound)
+	}
+
+	return updateUser(username, fmt.Sprintf("Grant %s access to %s for %s", role, app, username), func(user *user) error {
+		if user.Roles[app] == role {
+			fmt.Printf("User %s already has %s access to %s\n", username, role, app)
+			return errUnchanged
+		}
+
+		if user.Roles == nil {
+			user.Roles = map[string]string{}
+		}
+		user.Roles[app] = role
+		return nil
+	})
+}
+
+// MigrateUsers rewrites every user file still on an older schema in a single
+// commit and returns the names of the migrated users.
+func MigrateUsers() ([]string, error) {
+	files, err := getStore().ListDir("users")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated []string
+	var changes []FileChange
+	for _, file := range files {
+		if file.Type != "file" || !strings.HasSuffix(file.Name, ".json") {
+			continue
+		}
+		fullFile, err := getStore().ReadFile(file.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		user := user{}
+		if err := json.Unmarshal(fullFile.Content, &user); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", file.Path, err)
+		}
+		if !migrateUser(&user) {
+			continue
+		}
+
+		userJson, _ := json.MarshalIndent(user, "", "\t")
+		changes = append(changes, FileChange{Path: file.Path, Content: userJson, SHA: fullFile.SHA})
+		migrated = append(migrated, user.Username)
+	}
+
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	_, err = getStore().Commit(fmt.Sprintf("Migrate %d users to schema version %d", len(changes), userSchemaVersion), changes)
+	return migrated, err
+}
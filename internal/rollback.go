@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// provisionRollback undoes what a provisioning created when it fails or is
+// interrupted, so that nothing is left behind. Each created resource adds a
+// compensation, and they run most recent first.
+//
+// An interrupt does not undo anything by itself, since the current step may
+// still be creating something. It stops provisioning once that step returns,
+// and the provisioning rolls back as if the step had failed.
+//
+// Each compensation that succeeds removes the step that created what it
+// undid, and every later step, from the journal. If the rollback is partial,
+// resuming the provisioning then recreates what was undone instead of
+// continuing on top of it.
+type provisionRollback struct {
+	app         string
+	journal     *provisionJournal
+	keep        bool
+	mutex       sync.Mutex
+	undo        []compensation
+	interrupted chan struct{}
+	stop        sync.Once
+	finished    chan struct{}
+	unregister  func()
+}
+
+type compensation struct {
+	step    string
+	message string
+	f       func() error
+}
+
+// newProvisionRollback starts tracking a provisioning of app recorded in
+// journal. With keep, it never undoes anything, so the journal can be used to
+// resume.
+func newProvisionRollback(app string, journal *provisionJournal, keep bool) *provisionRollback {
+	r := &provisionRollback{app: app, journal: journal, keep: keep, interrupted: make(chan struct{}), finished: make(chan struct{})}
+	r.unregister = onInterrupt(r.interrupt)
+	return r
+}
+
+// interrupt stops provisioning and waits until it has finished, rolling back
+// unless keep.
+func (r *provisionRollback) interrupt() {
+	r.stop.Do(func() {
+		close(r.interrupted)
+	})
+	fmt.Println("STOPPING AFTER THE CURRENT STEP")
+	<-r.finished
+}
+
+// check returns ErrInterrupted once provisioning was interrupted. Steps call
+// it between anything that creates resources.
+func (r *provisionRollback) check() error {
+	select {
+	case <-r.interrupted:
+		return fmt.Errorf("provisioning %s: %w", r.app, ErrInterrupted)
+	default:
+		return nil
+	}
+}
+
+// sleep waits for d, or returns ErrInterrupted as soon as provisioning is
+// interrupted.
+func (r *provisionRollback) sleep(d time.Duration) error {
+	select {
+	case <-r.interrupted:
+		return r.check()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// add registers f to undo what step created.
+func (r *provisionRollback) add(step string, message string, f func() error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.undo = append(r.undo, compensation{step, message, f})
+}
+
+// finish undoes everything if provisioning failed with err, and lets an
+// interrupt that is waiting for it continue. It returns err, as ErrInterrupted
+// if provisioning was interrupted, since the step that failed may only have
+// failed because of that.
+func (r *provisionRollback) finish(err error) error {
+	defer close(r.finished)
+	r.unregister()
+	if err == nil {
+		return nil
+	}
+	if r.check() != nil && !errors.Is(err, ErrInterrupted) {
+		err = fmt.Errorf("provisioning %s: %s: %w", r.app, err, ErrInterrupted)
+	}
+
+	if r.keep {
+		fmt.Fprintf(os.Stderr, "Provisioning %s stopped, continue it with send provision --resume %s\n", r.app, r.app)
+		return err
+	}
+	r.run()
+	return err
+}
+
+// run runs the compensations. The local bundle, and with it the journal, is
+// only removed if all of them succeeded, so that whatever is left can still
+// be found and the provisioning resumed.
+func (r *provisionRollback) run() {
+	r.mutex.Lock()
+	undo := r.undo
+	r.mutex.Unlock()
+
+	fmt.Printf("ROLLING BACK PROVISIONING OF %s\n", strings.ToUpper(r.app))
+	failed := false
+	for i := len(undo) - 1; i >= 0; i-- {
+		fmt.Println(undo[i].message)
+		if err := undo[i].f(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+			failed = true
+			continue
+		}
+		if err := r.journal.forget(undo[i].step); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+		}
+	}
+
+	bundleDir := filepath.Join(homeDir, ".send", r.app)
+	if failed {
+		fmt.Fprintf(os.Stderr, "Not everything could be rolled back, %s records what was created\n", provisionJournalPath(r.app))
+		return
+	}
+	if err := os.RemoveAll(bundleDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not remove %s: %s\n", bundleDir, err)
+	}
+}
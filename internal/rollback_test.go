@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPartialRollbackForgetsUndoneSteps(t *testing.T) {
+	previous := homeDir
+	homeDir = t.TempDir()
+	defer func() { homeDir = previous }()
+
+	journal, err := newProvisionJournal("app", "fake", "", ServerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rollback := newProvisionRollback("app", journal, false)
+	for _, step := range []string{"generate keys", "register key", "create server", "wait for server", "commit bundle"} {
+		if err := journal.run(step, step, func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rollback.add("register key", "DELETING SSH KEY", func() error { return nil })
+	rollback.add("create server", "DESTROYING SERVER", func() error { return nil })
+	rollback.add("commit bundle", "REMOVING APP BUNDLE", func() error { return errors.New("store unavailable") })
+	rollback.finish(ErrInterrupted)
+
+	// The server and key are gone, so resuming must create them again
+	loaded, err := loadProvisionJournal("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"generate keys"}; !reflect.DeepEqual(loaded.Steps, want) {
+		t.Errorf("steps after partial rollback = %v, want %v", loaded.Steps, want)
+	}
+}
+
+func TestRollbackRemovesJournal(t *testing.T) {
+	previous := homeDir
+	homeDir = t.TempDir()
+	defer func() { homeDir = previous }()
+
+	journal, err := newProvisionJournal("app", "fake", "", ServerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rollback := newProvisionRollback("app", journal, false)
+	if err := journal.run("register key", "register key", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	rollback.add("register key", "DELETING SSH KEY", func() error { return nil })
+	rollback.finish(ErrInterrupted)
+
+	if _, err := loadProvisionJournal("app"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("loadProvisionJournal() after rollback = %v, want %v", err, ErrNotFound)
+	}
+}
@@ -1,26 +1,44 @@
 package internal
 
-import (
-	"fmt"
-	"os"
-	"os/exec"
-)
+type slackNotifier struct {
+	hookURL string
+	channel string
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackBlock struct {
+	Type   string      `json:"type"`
+	Text   *slackText  `json:"text,omitempty"`
+	Fields []slackText `json:"fields,omitempty"`
+}
+
+type slackMessage struct {
+	Channel string       `json:"channel,omitempty"`
+	Text    string       `json:"text"`
+	Blocks  []slackBlock `json:"blocks"`
+}
+
+func (s *slackNotifier) Notify(n Notification) error {
+	message := slackMessage{
+		Channel: s.channel,
+		Text:    n.Text,
+		Blocks:  []slackBlock{{Type: "section", Text: &slackText{"mrkdwn", n.Text}}},
+	}
 
-func SendToSlack(message string) {
-	messagePayload := fmt.Sprintf(`{"text":"%s"}`, message)
-	slackHookURL := os.Getenv("SEND_UPDATES_HOOK_URL")
-	cmd := exec.Command(
-		"curl",
-		"-X",
-		"POST",
-		"-H",
-		"'Content-type: application/json'",
-		"--data",
-		messagePayload,
-		slackHookURL,
-	)
-	_, err := cmd.Output()
-	if err != nil {
-		fmt.Printf("error occurred sending slack message: %s\n", err)
+	var fields []slackText
+	if n.App != "" {
+		fields = append(fields, slackText{"mrkdwn", "*App*\n" + n.App})
 	}
+	if n.User != "" {
+		fields = append(fields, slackText{"mrkdwn", "*User*\n" + n.User})
+	}
+	if len(fields) > 0 {
+		message.Blocks = append(message.Blocks, slackBlock{Type: "section", Fields: fields})
+	}
+
+	return postJSON(s.hookURL, message)
 }
@@ -0,0 +1,446 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const sshUser = "appdev"
+
+type CommandResult struct {
+	Stdout     []byte
+	Stderr     []byte
+	ExitStatus int
+}
+
+type sshClient struct {
+	client        *ssh.Client
+	removeCleanup func()
+}
+
+const hostKeyFile = "host_key"
+
+// dialSSH connects to host with a private key that is only ever held in
+// memory. The connection is closed by RunCleanups if the CLI is interrupted.
+func dialSSH(host string, pemKey []byte, hostKeys hostKeyPolicy, timeout time.Duration) (*sshClient, error) {
+	signer, err := ssh.ParsePrivateKey(pemKey)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing server key: %w", err)
+	}
+
+	// ssh.Dial flattens the callback's error into a string, so keep it to
+	// report a rejected host key with its own exit code.
+	var hostKeyErr error
+	client, err := ssh.Dial("tcp", net.JoinHostPort(host, "22"), &ssh.ClientConfig{
+		User: sshUser,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = hostKeys.callback(hostname, remote, key)
+			return hostKeyErr
+		},
+		HostKeyAlgorithms: hostKeys.algorithms,
+		Timeout:           timeout,
+	})
+	if hostKeyErr != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", host, hostKeyErr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %s: %w", host, err, ErrRemoteFailure)
+	}
+	return &sshClient{client, onCleanup(func() { client.Close() })}, nil
+}
+
+// connectToApp opens an SSH connection to the manager of an app using the
+// server key stored in the devops repo. The server must present the host key
+// pinned for the app when it was provisioned.
+func connectToApp(app string) (*sshClient, error) {
+	host, err := getHost(app)
+	if err != nil {
+		return nil, err
+	}
+
+	pinned, err := getHostKey(app)
+	if err != nil {
+		return nil, err
+	}
+
+	pemKey, err := getStore().ReadFile(app + "/server.pem")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching pem key for %s: %w", app, err)
+	}
+	// The key is never written to disk, and the raw copy is wiped as soon
+	// as it has been parsed.
+	defer zero(pemKey.Content)
+
+	return dialSSH(host, pemKey.Content, pinnedHostKey(pinned), 30*time.Second)
+}
+
+type hostKeyPolicy struct {
+	callback   ssh.HostKeyCallback
+	algorithms []string
+}
+
+// pinnedHostKey only accepts the given key. The server is asked for a key of
+// the same type, so a host that also has keys of other types still matches.
+func pinnedHostKey(pinned ssh.PublicKey) hostKeyPolicy {
+	return hostKeyPolicy{
+		callback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if !bytes.Equal(key.Marshal(), pinned.Marshal()) {
+				return fmt.Errorf("%s presented host key %s but %s is pinned: %w",
+					hostname, ssh.FingerprintSHA256(key), ssh.FingerprintSHA256(pinned), ErrHostKeyMismatch)
+			}
+			return nil
+		},
+		algorithms: []string{pinned.Type()},
+	}
+}
+
+// captureHostKey accepts whatever key the server presents and stores it in
+// captured. It is only used for servers that have no pinned key yet.
+func captureHostKey(captured *ssh.PublicKey) hostKeyPolicy {
+	return hostKeyPolicy{
+		callback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			*captured = key
+			return nil
+		},
+	}
+}
+
+func getHostKey(app string) (ssh.PublicKey, error) {
+	file, err := getStore().ReadFile(app + "/" + hostKeyFile)
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("no host key is pinned for %s, an admin can pin one with send pin-host-key %s: %w", app, app, ErrHostKeyMismatch)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(file.Content)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing host key for %s: %s: %w", app, err, ErrInvalidInput)
+	}
+	return key, nil
+}
+
+// pinHostKey records key as the only host key accepted for the app's server.
+func pinHostKey(app string, key ssh.PublicKey) error {
+	path := app + "/" + hostKeyFile
+	sha := ""
+	if file, err := getStore().ReadFile(path); err == nil {
+		sha = file.SHA
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	message := fmt.Sprintf("Pin host key %s for %s", ssh.FingerprintSHA256(key), app)
+	_, err := getStore().WriteFile(path, ssh.MarshalAuthorizedKey(key), sha, message)
+	return err
+}
+
+// PinHostKey connects to the app's server, pins the host key it presents and
+// returns the key's fingerprint. This trusts the network for one connection,
+// so it is meant for apps provisioned before keys were pinned and for servers
+// whose host key was deliberately replaced.
+func PinHostKey(app string) (string, error) {
+	host, err := getHost(app)
+	if err != nil {
+		return "", err
+	}
+
+	pemKey, err := getStore().ReadFile(app + "/server.pem")
+	if err != nil {
+		return "", fmt.Errorf("error fetching pem key for %s: %w", app, err)
+	}
+	defer zero(pemKey.Content)
+
+	var key ssh.PublicKey
+	client, err := dialSSH(host, pemKey.Content, captureHostKey(&key), 30*time.Second)
+	if err != nil {
+		return "", err
+	}
+	client.Close()
+
+	if err := pinHostKey(app, key); err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(key), nil
+}
+
+// Run executes command and returns its output. A non-zero exit status is
+// reported in the result rather than as an error.
+func (c *sshClient) Run(command string) (*CommandResult, error) {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("error opening ssh session: %s: %w", err, ErrRemoteFailure)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	result := &CommandResult{}
+	err = session.Run(command)
+	result.Stdout = stdout.Bytes()
+	result.Stderr = stderr.Bytes()
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitStatus = exitErr.ExitStatus()
+	} else if err != nil {
+		return result, fmt.Errorf("error running %q: %s: %w", command, err, ErrRemoteFailure)
+	}
+	return result, nil
+}
+
+// RunStreaming runs command and copies its output to stdout and stderr as it
+// is produced. A non-zero exit status is returned rather than an error.
+func (c *sshClient) RunStreaming(command string, stdout io.Writer, stderr io.Writer) (int, error) {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return 0, fmt.Errorf("error opening ssh session: %s: %w", err, ErrRemoteFailure)
+	}
+	defer session.Close()
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	err = session.Run(command)
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error running %q: %s: %w", command, err, ErrRemoteFailure)
+	}
+	return 0, nil
+}
+
+// Stream runs command with the local stdin, stdout and stderr attached and
+// returns its exit status. With tty set, a PTY is allocated on the server and
+// the local terminal is in raw mode until the command exits.
+func (c *sshClient) Stream(command string, tty bool) (int, error) {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return 0, fmt.Errorf("error opening ssh session: %s: %w", err, ErrRemoteFailure)
+	}
+	defer session.Close()
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	if tty {
+		restore, err := requestPTY(session)
+		if err != nil {
+			return 0, err
+		}
+		defer restore()
+	}
+
+	stopForwarding := forwardSignals(func(sig os.Signal) {
+		if sig == os.Interrupt {
+			session.Signal(ssh.SIGINT)
+		} else {
+			session.Signal(ssh.SIGTERM)
+		}
+	})
+	defer stopForwarding()
+
+	err = session.Run(command)
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error running %q: %s: %w", command, err, ErrRemoteFailure)
+	}
+	return 0, nil
+}
+
+// requestPTY allocates a PTY the size of the local terminal, puts the local
+// terminal into raw mode and keeps the remote size in sync. Like ssh -t, it
+// does nothing if stdin is not a terminal.
+func requestPTY(session *ssh.Session) (restore func(), err error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		fmt.Fprintln(os.Stderr, "Pseudo-terminal will not be allocated because stdin is not a terminal.")
+		return func() {}, nil
+	}
+
+	width, height, err := terminal.GetSize(fd)
+	if err != nil {
+		width, height = 80, 24
+	}
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = "xterm-256color"
+	}
+	modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+	if err := session.RequestPty(term, height, width, modes); err != nil {
+		return nil, fmt.Errorf("error allocating pty: %s: %w", err, ErrRemoteFailure)
+	}
+
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return nil, fmt.Errorf("error setting terminal to raw mode: %w", err)
+	}
+	// The terminal must be usable again even if the CLI is interrupted.
+	removeCleanup := onCleanup(func() { terminal.Restore(fd, state) })
+
+	stopWatching := watchWindowSize(func() {
+		if width, height, err := terminal.GetSize(fd); err == nil {
+			session.WindowChange(height, width)
+		}
+	})
+
+	return func() {
+		stopWatching()
+		removeCleanup()
+		terminal.Restore(fd, state)
+	}, nil
+}
+
+// Upload copies files, keyed by their remote path, over a single SFTP
+// session. Relative paths are resolved against the home directory of the ssh
+// user. Every file is staged before any is moved into place, so the server
+// never sees a mix of old and new files for long.
+func (c *sshClient) Upload(files map[string][]byte) error {
+	client, err := sftp.NewClient(c.client)
+	if err != nil {
+		return fmt.Errorf("error starting sftp: %s: %w", err, ErrRemoteFailure)
+	}
+	defer client.Close()
+
+	var remotePaths []string
+	for remotePath := range files {
+		remotePaths = append(remotePaths, remotePath)
+	}
+	sort.Strings(remotePaths)
+
+	var staged []string
+	defer func() {
+		for _, stagedPath := range staged {
+			client.Remove(stagedPath)
+		}
+	}()
+	for _, remotePath := range remotePaths {
+		stagedPath := path.Join(path.Dir(remotePath), ".send-"+path.Base(remotePath))
+		if err := uploadFile(client, files[remotePath], stagedPath); err != nil {
+			return err
+		}
+		staged = append(staged, stagedPath)
+	}
+
+	for i, remotePath := range remotePaths {
+		if err := client.PosixRename(staged[i], remotePath); err != nil {
+			return fmt.Errorf("error moving %s into place: %s: %w", remotePath, err, ErrRemoteFailure)
+		}
+	}
+	staged = nil
+	return nil
+}
+
+func uploadFile(client *sftp.Client, content []byte, remotePath string) error {
+	if err := client.MkdirAll(path.Dir(remotePath)); err != nil {
+		return fmt.Errorf("error creating %s: %s: %w", path.Dir(remotePath), err, ErrRemoteFailure)
+	}
+	file, err := client.Create(remotePath)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %s: %w", remotePath, err, ErrRemoteFailure)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(content); err != nil {
+		return fmt.Errorf("error writing %s: %s: %w", remotePath, err, ErrRemoteFailure)
+	}
+	return nil
+}
+
+// Download returns the content of remotePath, or ErrNotFound if there is no
+// such file.
+func (c *sshClient) Download(remotePath string) ([]byte, error) {
+	client, err := sftp.NewClient(c.client)
+	if err != nil {
+		return nil, fmt.Errorf("error starting sftp: %s: %w", err, ErrRemoteFailure)
+	}
+	defer client.Close()
+
+	file, err := client.Open(remotePath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", remotePath, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %s: %w", remotePath, err, ErrRemoteFailure)
+	}
+	defer file.Close()
+
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s: %w", remotePath, err, ErrRemoteFailure)
+	}
+	return content, nil
+}
+
+// ListFiles returns the names of the regular files in remoteDir. A directory
+// that does not exist has no files.
+func (c *sshClient) ListFiles(remoteDir string) ([]string, error) {
+	client, err := sftp.NewClient(c.client)
+	if err != nil {
+		return nil, fmt.Errorf("error starting sftp: %s: %w", err, ErrRemoteFailure)
+	}
+	defer client.Close()
+
+	infos, err := client.ReadDir(remoteDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %s: %w", remoteDir, err, ErrRemoteFailure)
+	}
+
+	var names []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// Remove deletes remotePath. A file that does not exist is not an error.
+func (c *sshClient) Remove(remotePath string) error {
+	client, err := sftp.NewClient(c.client)
+	if err != nil {
+		return fmt.Errorf("error starting sftp: %s: %w", err, ErrRemoteFailure)
+	}
+	defer client.Close()
+
+	if err := client.Remove(remotePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing %s: %s: %w", remotePath, err, ErrRemoteFailure)
+	}
+	return nil
+}
+
+func (c *sshClient) Close() error {
+	c.removeCleanup()
+	return c.client.Close()
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
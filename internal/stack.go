@@ -0,0 +1,329 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stackName is the name an app's docker-compose files are deployed under on
+// its swarm. Services in the stack are named <stack>_<service>.
+func stackName(app string) string {
+	return app
+}
+
+// getServices returns the names of the services in the app's stack, without
+// the stack prefix.
+func getServices(client *sshClient, app string) ([]string, error) {
+	command := "docker stack services --format '{{.Name}}' " + shellQuote(stackName(app))
+	result, err := client.Run(command)
+	if err != nil {
+		return nil, err
+	}
+	if result.ExitStatus != 0 {
+		return nil, fmt.Errorf("error listing services of %s: %s: %w", app, strings.TrimSpace(string(result.Stderr)), ErrRemoteFailure)
+	}
+
+	return parseServices(app, string(result.Stdout)), nil
+}
+
+// parseServices parses the output of docker stack services listing names.
+func parseServices(app string, output string) []string {
+	var services []string
+	for _, name := range strings.Fields(output) {
+		services = append(services, strings.TrimPrefix(name, stackName(app)+"_"))
+	}
+	sort.Strings(services)
+	return services
+}
+
+// getComposeFiles returns the paths of the app's docker-compose files on its
+// server, relative to the ssh user's home directory.
+func getComposeFiles(app string) ([]string, error) {
+	files, err := getStore().ListDir(app + "/docker-compose")
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("no config found for %s: %w", app, ErrAppNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, file := range files {
+		if file.Type == "file" && (strings.HasSuffix(file.Name, ".yml") || strings.HasSuffix(file.Name, ".yaml")) {
+			paths = append(paths, "docker-compose/"+file.Name)
+		}
+	}
+	sort.Strings(paths)
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s has no docker-compose files: %w", app, ErrNotFound)
+	}
+	return paths, nil
+}
+
+// DeployApp deploys the app's docker-compose files to its swarm and waits up
+// to timeout for every service to converge. If a service fails to, the errors
+// of its failed tasks are returned.
+func DeployApp(app string, timeout time.Duration) error {
+	composeFiles, err := getComposeFiles(app)
+	if err != nil {
+		return err
+	}
+
+	client, err := connectToApp(app)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	before, err := getServiceSpecs(client, app)
+	if err != nil {
+		return err
+	}
+
+	command := "docker stack deploy --with-registry-auth"
+	for _, path := range composeFiles {
+		command += " -c " + shellQuote(path)
+	}
+	command += " " + shellQuote(stackName(app))
+
+	status, err := client.RunStreaming(command, os.Stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("docker stack deploy for %s exited with status %d: %w", app, status, ErrRemoteFailure)
+	}
+
+	after, err := getServiceSpecs(client, app)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Waiting for services to converge")
+	return waitForConvergence(client, app, changedServices(before, after), timeout)
+}
+
+// serviceSpec is the task template of a service, which swarm rolls out to
+// its tasks in an update when it changes, and when its latest update started
+// in nanoseconds since the epoch, or 0 if it was never updated.
+type serviceSpec struct {
+	template      string
+	updateStarted int64
+}
+
+const updateStartedFormat = "{{if .UpdateStatus}}{{if .UpdateStatus.StartedAt}}{{.UpdateStatus.StartedAt.UnixNano}}{{end}}{{end}}"
+
+// getServiceSpecs returns the specs of the app's deployed services by name,
+// none if the app was never deployed.
+func getServiceSpecs(client *sshClient, app string) (map[string]serviceSpec, error) {
+	services, err := getServices(client, app)
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return map[string]serviceSpec{}, nil
+	}
+
+	command := "docker service inspect --format '{{.Spec.Name}} 0" + updateStartedFormat + " {{json .Spec.TaskTemplate}}'"
+	for _, service := range services {
+		command += " " + shellQuote(stackName(app)+"_"+service)
+	}
+	result, err := client.Run(command)
+	if err != nil {
+		return nil, err
+	}
+	if result.ExitStatus != 0 {
+		return nil, fmt.Errorf("error inspecting services of %s: %s: %w", app, strings.TrimSpace(string(result.Stderr)), ErrRemoteFailure)
+	}
+
+	return parseServiceSpecs(app, string(result.Stdout)), nil
+}
+
+// parseServiceSpecs parses the name, update start and task template listed
+// by docker service inspect, one service per line. The update start is
+// prefixed with 0 so that it is never empty.
+func parseServiceSpecs(app string, output string) map[string]serviceSpec {
+	specs := map[string]serviceSpec{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		started, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		name := strings.TrimPrefix(fields[0], stackName(app)+"_")
+		specs[name] = serviceSpec{template: strings.TrimSpace(fields[2]), updateStarted: started}
+	}
+	return specs
+}
+
+// changedServices returns the services whose task template changed between
+// before and after a deploy, with when their latest update before it
+// started. Swarm updates the tasks of these, new services are created as is.
+func changedServices(before, after map[string]serviceSpec) map[string]int64 {
+	changed := map[string]int64{}
+	for name, spec := range after {
+		if previous, ok := before[name]; ok && previous.template != spec.template {
+			changed[name] = previous.updateStarted
+		}
+	}
+	return changed
+}
+
+type serviceStatus struct {
+	name          string
+	running       int
+	desired       int
+	updateState   string
+	updateStarted int64
+}
+
+// converged reports whether all of the service's replicas are running and
+// any update of it has completed.
+func (s serviceStatus) converged() bool {
+	return s.running == s.desired && (s.updateState == "" || s.updateState == "completed")
+}
+
+// updatedSince reports whether an update of the service that started after
+// started, in nanoseconds since the epoch, has completed.
+func (s serviceStatus) updatedSince(started int64) bool {
+	return s.updateState == "completed" && s.updateStarted > started
+}
+
+// failed reports whether swarm gave up updating the service.
+func (s serviceStatus) failed() bool {
+	return s.updateState == "paused" || strings.HasPrefix(s.updateState, "rollback_")
+}
+
+// waitForConvergence waits up to timeout for the app's services to converge.
+// The services in changed, by when their latest update started before the
+// deploy, have only converged once swarm completed a later update of them.
+func waitForConvergence(client *sshClient, app string, changed map[string]int64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		statuses, err := getServiceStatuses(client, app)
+		if err != nil {
+			return err
+		}
+
+		var pending []string
+		for _, status := range statuses {
+			if status.failed() {
+				return serviceFailure(client, app, status.name, fmt.Sprintf("update %s", strings.Replace(status.updateState, "_", " ", -1)))
+			}
+			since, updating := changed[status.name]
+			if !status.converged() || updating && !status.updatedSince(since) {
+				pending = append(pending, status.name)
+			}
+		}
+		if len(pending) == 0 {
+			fmt.Printf("All %d services of %s are running\n", len(statuses), app)
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return serviceFailure(client, app, pending[0], fmt.Sprintf("did not converge within %s", timeout))
+		}
+		fmt.Printf("Waiting for %s\n", strings.Join(pending, ", "))
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func getServiceStatuses(client *sshClient, app string) ([]serviceStatus, error) {
+	services, err := getServices(client, app)
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("%s has no services deployed: %w", app, ErrNotFound)
+	}
+
+	command := "docker stack services --format '{{.Name}} {{.Replicas}}' " + shellQuote(stackName(app)) +
+		" && docker service inspect --format '{{.Spec.Name}} {{if .UpdateStatus}}{{.UpdateStatus.State}}{{end}} " + updateStartedFormat + "'"
+	for _, service := range services {
+		command += " " + shellQuote(stackName(app)+"_"+service)
+	}
+	result, err := client.Run(command)
+	if err != nil {
+		return nil, err
+	}
+	if result.ExitStatus != 0 {
+		return nil, fmt.Errorf("error inspecting services of %s: %s: %w", app, strings.TrimSpace(string(result.Stderr)), ErrRemoteFailure)
+	}
+
+	return parseServiceStatuses(app, services, string(result.Stdout)), nil
+}
+
+// parseServiceStatuses parses the replicas listed by docker stack services
+// and the update states and starts listed by docker service inspect, one
+// service per line each, into the statuses of services in the same order.
+func parseServiceStatuses(app string, services []string, output string) []serviceStatus {
+	statuses := map[string]*serviceStatus{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.TrimPrefix(fields[0], stackName(app)+"_")
+		status, ok := statuses[name]
+		if !ok {
+			status = &serviceStatus{name: name}
+			statuses[name] = status
+		}
+		if len(fields) < 2 {
+			continue
+		}
+
+		// Replicas are listed as running/desired, update states are words
+		var running, desired int
+		if n, _ := fmt.Sscanf(fields[1], "%d/%d", &running, &desired); n == 2 {
+			status.running, status.desired = running, desired
+		} else {
+			status.updateState = fields[1]
+			if len(fields) > 2 {
+				status.updateStarted, _ = strconv.ParseInt(fields[2], 10, 64)
+			}
+		}
+	}
+
+	var ordered []serviceStatus
+	for _, service := range services {
+		if status, ok := statuses[service]; ok {
+			ordered = append(ordered, *status)
+		}
+	}
+	return ordered
+}
+
+// serviceFailure describes why service failed to deploy, including the error
+// of its most recent failed task.
+func serviceFailure(client *sshClient, app string, service string, reason string) error {
+	message := fmt.Sprintf("service %s %s", service, reason)
+
+	command := "docker service ps --no-trunc --format '{{.Name}}\t{{.CurrentState}}\t{{.Error}}' " + shellQuote(stackName(app)+"_"+service)
+	result, err := client.Run(command)
+	if err == nil && result.ExitStatus == 0 {
+		message += taskError(string(result.Stdout))
+	}
+	return fmt.Errorf("%s: %w", message, ErrRemoteFailure)
+}
+
+// taskError describes the first task with an error in the tab separated
+// name, state and error listed by docker service ps, newest first. It is
+// empty if no task has an error.
+func taskError(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) == 3 && strings.TrimSpace(fields[2]) != "" {
+			return fmt.Sprintf(": task %s (%s): %s", fields[0], fields[1], strings.TrimSpace(fields[2]))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseServices(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{"none", "", nil},
+		{"sorted without prefix", "app_web\napp_db\n", []string{"db", "web"}},
+		{"other prefix kept", "app_web\nother_db\n", []string{"other_db", "web"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseServices("app", test.output); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseServices(%q) = %v, want %v", test.output, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseServiceStatuses(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []string
+		output   string
+		want     []serviceStatus
+	}{
+		{
+			"replicas and no update",
+			[]string{"db", "web"},
+			"app_web 2/3\napp_db 1/1\napp_db \napp_web \n",
+			[]serviceStatus{{"db", 1, 1, "", 0}, {"web", 2, 3, "", 0}},
+		},
+		{
+			"update states",
+			[]string{"db", "web"},
+			"app_db 1/1\napp_web 0/1\napp_db completed 100\napp_web rollback_started 200\n",
+			[]serviceStatus{{"db", 1, 1, "completed", 100}, {"web", 0, 1, "rollback_started", 200}},
+		},
+		{
+			"missing service skipped",
+			[]string{"db", "web"},
+			"app_web 1/1\napp_web updating 100\n",
+			[]serviceStatus{{"web", 1, 1, "updating", 100}},
+		},
+		{
+			"empty output",
+			[]string{"web"},
+			"",
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseServiceStatuses("app", test.services, test.output)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseServiceStatuses(%q) = %+v, want %+v", test.output, got, test.want)
+			}
+		})
+	}
+}
+
+func TestServiceStatusState(t *testing.T) {
+	tests := []struct {
+		status    serviceStatus
+		converged bool
+		failed    bool
+	}{
+		{serviceStatus{"web", 1, 1, "", 0}, true, false},
+		{serviceStatus{"web", 1, 1, "completed", 0}, true, false},
+		{serviceStatus{"web", 0, 1, "", 0}, false, false},
+		{serviceStatus{"web", 1, 1, "updating", 0}, false, false},
+		{serviceStatus{"web", 1, 1, "paused", 0}, false, true},
+		{serviceStatus{"web", 1, 1, "rollback_completed", 0}, false, true},
+	}
+	for _, test := range tests {
+		if got := test.status.converged(); got != test.converged {
+			t.Errorf("%+v.converged() = %v, want %v", test.status, got, test.converged)
+		}
+		if got := test.status.failed(); got != test.failed {
+			t.Errorf("%+v.failed() = %v, want %v", test.status, got, test.failed)
+		}
+	}
+}
+
+func TestServiceStatusUpdatedSince(t *testing.T) {
+	tests := []struct {
+		status  serviceStatus
+		started int64
+		want    bool
+	}{
+		{serviceStatus{"web", 1, 1, "", 0}, 0, false},
+		{serviceStatus{"web", 1, 1, "completed", 100}, 100, false},
+		{serviceStatus{"web", 1, 1, "updating", 200}, 100, false},
+		{serviceStatus{"web", 1, 1, "completed", 200}, 100, true},
+		{serviceStatus{"web", 1, 1, "completed", 200}, 0, true},
+	}
+	for _, test := range tests {
+		if got := test.status.updatedSince(test.started); got != test.want {
+			t.Errorf("%+v.updatedSince(%d) = %v, want %v", test.status, test.started, got, test.want)
+		}
+	}
+}
+
+func TestParseServiceSpecs(t *testing.T) {
+	output := "app_db 0 {\"ContainerSpec\":{\"Image\":\"postgres\"}}\n" +
+		"app_web 0100 {\"ContainerSpec\":{\"Image\":\"web:2\", \"Args\":[\"a b\"]}}\n" +
+		"app_broken \n"
+	want := map[string]serviceSpec{
+		"db":  {`{"ContainerSpec":{"Image":"postgres"}}`, 0},
+		"web": {`{"ContainerSpec":{"Image":"web:2", "Args":["a b"]}}`, 100},
+	}
+	if got := parseServiceSpecs("app", output); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseServiceSpecs(%q) = %+v, want %+v", output, got, want)
+	}
+}
+
+func TestChangedServices(t *testing.T) {
+	before := map[string]serviceSpec{
+		"db":  {"postgres", 0},
+		"web": {"web:1", 100},
+		"old": {"old", 0},
+	}
+	after := map[string]serviceSpec{
+		"db":  {"postgres", 0},
+		"web": {"web:2", 100},
+		"new": {"new", 0},
+	}
+	want := map[string]int64{"web": 100}
+	if got := changedServices(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("changedServices() = %v, want %v", got, want)
+	}
+}
+
+func TestTaskError(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{"no tasks", "", ""},
+		{"no errors", "app_web.1\tRunning 5 minutes ago\t\n", ""},
+		{
+			"first error",
+			"app_web.1\tRunning 1 second ago\t\napp_web.1\tFailed 1 minute ago\ttask: non-zero exit (1)\napp_web.1\tFailed 2 minutes ago\tolder\n",
+			": task app_web.1 (Failed 1 minute ago): task: non-zero exit (1)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := taskError(test.output); got != test.want {
+				t.Errorf("taskError(%q) = %q, want %q", test.output, got, test.want)
+			}
+		})
+	}
+}
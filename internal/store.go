@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"time"
+)
+
+// ConfigStore is the backing store for the devops repository that holds app
+// bundles and user files. Paths are slash separated and relative to the root
+// of the repository.
+type ConfigStore interface {
+	// ReadFile returns the contents of a file along with its blob SHA.
+	ReadFile(path string) (*File, error)
+	// ListDir returns the entries of a directory without their contents.
+	ListDir(path string) ([]*File, error)
+	// ReadFileAt and ListDirAt are ReadFile and ListDir as of an earlier
+	// commit.
+	ReadFileAt(path string, commitSHA string) (*File, error)
+	ListDirAt(path string, commitSHA string) ([]*File, error)
+	// WriteFile creates or updates a single file and returns the SHA of the
+	// resulting commit. sha must be the current blob SHA of the file, or
+	// empty if the file is expected not to exist yet.
+	WriteFile(path string, content []byte, sha string, message string) (string, error)
+	// Commit applies all changes as a single commit and returns its SHA. It
+	// fails with ErrConflict if a change's file no longer has its SHA.
+	Commit(message string, changes []FileChange) (string, error)
+	// History returns the commits touching path, newest first.
+	History(path string) ([]Revision, error)
+	// OpenPullRequest commits changes to a new branch off the current head
+	// and opens a pull request with title and body to merge it back.
+	OpenPullRequest(branch string, title string, body string, changes []FileChange) (*PullRequest, error)
+	// GetPullRequest returns a pull request along with the paths it changes.
+	// The changes have no content.
+	GetPullRequest(number int) (*PullRequest, error)
+	// MergePullRequest merges an open pull request, provided its branch is
+	// still at headSHA, and returns the SHA of the merge commit.
+	MergePullRequest(number int, headSHA string, message string) (string, error)
+}
+
+type File struct {
+	Name    string
+	Path    string
+	Type    string
+	SHA     string
+	Content []byte
+}
+
+type FileChange struct {
+	Path    string
+	Content []byte
+	Delete  bool
+	// SHA, if set, is the blob SHA the file must have when the change is
+	// committed. Commit fails with ErrConflict if it has changed since.
+	SHA string
+}
+
+type Revision struct {
+	SHA     string
+	Author  string
+	Message string
+	Date    time.Time
+}
+
+type PullRequest struct {
+	Number  int
+	Title   string
+	Body    string
+	URL     string
+	State   string
+	Branch  string
+	HeadSHA string
+	Changes []FileChange
+}
+
+var store *commitTracker
+
+func getStore() ConfigStore {
+	if store == nil {
+		if config.StorePath != "" {
+			store = &commitTracker{ConfigStore: NewLocalStore(config.StorePath, config.Branch)}
+		} else {
+			store = &commitTracker{ConfigStore: NewGitHubStore(config.APIURL, config.Repository, config.Branch)}
+		}
+	}
+	return store
+}
+
+func SetConfigStore(s ConfigStore) {
+	store = &commitTracker{ConfigStore: s}
+}
+
+// commitTracker remembers the last commit made through a store so the audit
+// log can record what a command produced.
+type commitTracker struct {
+	ConfigStore
+	lastCommit string
+}
+
+func (t *commitTracker) WriteFile(path string, content []byte, sha string, message string) (string, error) {
+	commitSHA, err := t.ConfigStore.WriteFile(path, content, sha, message)
+	if err == nil {
+		t.lastCommit = commitSHA
+	}
+	return commitSHA, err
+}
+
+func (t *commitTracker) Commit(message string, changes []FileChange) (string, error) {
+	commitSHA, err := t.ConfigStore.Commit(message, changes)
+	if err == nil {
+		t.lastCommit = commitSHA
+	}
+	return commitSHA, err
+}
+
+func (t *commitTracker) OpenPullRequest(branch string, title string, body string, changes []FileChange) (*PullRequest, error) {
+	pr, err := t.ConfigStore.OpenPullRequest(branch, title, body, changes)
+	if err == nil {
+		t.lastCommit = pr.HeadSHA
+	}
+	return pr, err
+}
+
+func (t *commitTracker) MergePullRequest(number int, headSHA string, message string) (string, error) {
+	commitSHA, err := t.ConfigStore.MergePullRequest(number, headSHA, message)
+	if err == nil {
+		t.lastCommit = commitSHA
+	}
+	return commitSHA, err
+}
+
+// blobSHA returns the SHA git assigns to a blob with the given content.
+func blobSHA(content []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
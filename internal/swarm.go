@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -8,49 +10,184 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 var homeDir, _ = os.UserHomeDir()
 
-func ProvisionServerForApp(app string, size string) {
+// ProvisionServerForApp creates a server for a new app and sets it up.
+// providerIP is what the provider was created with, so that provisioning can
+// be resumed with the same provider if it is interrupted. Unless
+// keepOnFailure, everything it created is removed again if it fails.
+func ProvisionServerForApp(app string, provider CloudProvider, providerIP string, options ServerOptions, keepOnFailure bool) error {
+	if err := checkNoProvisionJournal(app); err != nil {
+		return err
+	}
+	if _, err := getStore().ListDir(app); err == nil {
+		return fmt.Errorf("app %s already exists, choose a different name: %w", app, ErrConflict)
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	journal, err := newProvisionJournal(app, provider.Name(), providerIP, options)
+	if err != nil {
+		return err
+	}
+	return provision(app, provider, journal, keepOnFailure)
+}
+
+// ResumeProvisioning continues an interrupted provisioning of app from the
+// first step that did not complete, with the provider and options it was
+// started with. Unless keepOnFailure, everything the provisioning created,
+// including before it was interrupted, is removed if it fails again.
+func ResumeProvisioning(app string, keepOnFailure bool) error {
+	journal, err := loadProvisionJournal(app)
+	if err != nil {
+		return err
+	}
+	provider, err := NewCloudProvider(journal.Provider, journal.ProviderIP)
+	if err != nil {
+		return err
+	}
+	return provision(app, provider, journal, keepOnFailure)
+}
+
+// provision runs the steps of provisioning that journal has not recorded as
+// completed. The journal is removed once all of them are. Each completed step
+// that created something adds a compensation to undo it on failure.
+func provision(app string, provider CloudProvider, journal *provisionJournal, keepOnFailure bool) (err error) {
+	rollback := newProvisionRollback(app, journal, keepOnFailure)
+	defer func() {
+		err = rollback.finish(err)
+	}()
+	// An interrupt takes effect before the next step, once the current one
+	// has recorded what it created
+	run := func(step string, message string, f func() error) error {
+		if err := rollback.check(); err != nil {
+			return err
+		}
+		return journal.run(step, message, f)
+	}
+
 	fmt.Println("SETTING UP SWARM CLI")
-	setupSwarmCLI()
+	if err := setupSwarmCLI(); err != nil {
+		return err
+	}
+	bundleDir := filepath.Join(homeDir, ".send", app)
+
+	err = run("generate keys", "GENERATING SERVER PEM KEYS", func() error {
+		return generatePemKeys(app)
+	})
+	if err != nil {
+		return err
+	}
 
-	if getDirectory(app) != nil {
-		fmt.Println("App " + app + " already exists. Choose a different name.")
-		os.Exit(1)
+	err = run("register key", fmt.Sprintf("REGISTERING SSH KEY WITH %s", strings.ToUpper(provider.Name())), func() error {
+		publicKey, err := ioutil.ReadFile(filepath.Join(bundleDir, "server.pem.pub"))
+		if err != nil {
+			return err
+		}
+		journal.KeyID, err = provider.RegisterKey(app, publicKey)
+		return err
+	})
+	if err != nil {
+		return err
 	}
-	os.Mkdir(filepath.Join(homeDir, ".send", app), os.ModePerm)
+	keyID := journal.KeyID
+	rollback.add("register key", "DELETING SSH KEY", func() error {
+		return provider.DeleteKey(keyID)
+	})
 
-	fmt.Println("GENERATING SERVER PEM KEYS")
-	generatePemKeys(app)
+	err = run("create server", fmt.Sprintf("CREATING SERVER ON %s", strings.ToUpper(provider.Name())), func() error {
+		serverID, err := provider.CreateServer(app, journal.Options, journal.KeyID)
+		journal.ServerID = serverID
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	serverID := journal.ServerID
+	rollback.add("create server", "DESTROYING SERVER", func() error {
+		return provider.DestroyServer(serverID)
+	})
 
-	fmt.Println("CREATING DROPLET ON DIGITALOCEAN")
-	dropletId := createDroplet(app, size)
+	err = run("wait for server", "WAITING FOR SERVER TO GET ASSIGNED AN IP ADDRESS", func() error {
+		for {
+			server, err := provider.GetServer(journal.ServerID)
+			if err != nil {
+				return err
+			}
+			if server.Status == ServerActive && server.IP != "" {
+				journal.ServerIP = server.IP
+				return nil
+			}
+			if err := rollback.sleep(5 * time.Second); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
 
-	fmt.Println("WAITING FOR DROPLET TO GET ASSIGNED AN IP ADDRESS")
-	for getDropletStatus(dropletId) != "active" {
-		time.Sleep(5 * time.Second)
+	err = run("commit bundle", "CONSTRUCTING APP BUNDLE FOR SWARM CLI", func() error {
+		if err := constructBundle(app, journal.ServerIP); err != nil {
+			return err
+		}
+		options := journal.Options
+		metadata := appMetadata{Provider: provider.Name(), ServerID: journal.ServerID, KeyID: journal.KeyID, Server: &options}
+		if err := writeBundleMetadata(app, metadata); err != nil {
+			return err
+		}
+		return commitBundle(app)
+	})
+	if err != nil {
+		return err
 	}
+	rollback.add("commit bundle", "REMOVING APP BUNDLE FROM DEVOPS REPO", func() error {
+		changes, err := appFileDeletions(app)
+		if err != nil {
+			return err
+		}
+		_, err = getStore().Commit("Remove deployment bundle of failed provisioning of "+app, changes)
+		return err
+	})
 
-	fmt.Println("CONSTRUCTING APP BUNDLE FOR SWARM CLI")
-	dropletIP := getDropletIP(dropletId)
-	constructBundle(app, dropletIP)
-	commitBundle(app)
+	err = run("pin host key", "WAITING FOR SERVER TO FINISH INITIALIZING", func() error {
+		var hostKey ssh.PublicKey
+		for hostKey == nil {
+			if hostKey = getServerHostKey(app, journal.ServerIP); hostKey == nil {
+				if err := rollback.sleep(5 * time.Second); err != nil {
+					return err
+				}
+			}
+		}
 
-	fmt.Println("WAITING FOR DROPLET TO FINISH INITIALIZING")
-	for !isDropletReady(dropletIP) {
-		time.Sleep(5 * time.Second)
+		// The server was just set up for us, so the key it presents on
+		// its first connection is pinned and required from then on.
+		return pinHostKey(app, hostKey)
+	})
+	if err != nil {
+		return err
 	}
 
-	runSwarmOnServer(app)
+	for _, command := range swarmCommands(bundleDir) {
+		err := run(command, "RUNNING SWARM COMMAND: "+command, func() error {
+			return runSwarmCommand(command)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return journal.remove()
 }
 
-func setupSwarmCLI() {
+func setupSwarmCLI() error {
 	path := filepath.Join(homeDir, ".send", "swarm-cli")
 	if _, err := os.Stat(path); !os.IsNotExist(err) {
 		// Swarm already setup
-		return
+		return nil
 	}
 
 	cloneCmd := exec.Command(
@@ -61,8 +198,7 @@ func setupSwarmCLI() {
 	)
 
 	if err := cloneCmd.Run(); err != nil {
-		fmt.Printf("Error cloning swarm cli: %s", err)
-		os.Exit(1)
+		return fmt.Errorf("error cloning swarm cli: %s: %w", err, ErrProviderFailure)
 	}
 
 	commands := []string{"virtualenv venv", "source venv/bin/activate", "pip install -r requirements.txt", "ansible-galaxy install --roles-path roles -r requirements.yml", "cp swarm.ini.in swarm.ini"}
@@ -72,71 +208,95 @@ func setupSwarmCLI() {
 	setupCmd.Stderr = os.Stderr
 
 	if err := setupCmd.Run(); err != nil {
-		fmt.Printf("Error setting up virtualenv and installing dependencies for swarm cli: %s", err)
-		os.Exit(1)
+		return fmt.Errorf("error setting up virtualenv and installing dependencies for swarm cli: %s: %w", err, ErrProviderFailure)
 	}
+	return nil
 }
 
-func generatePemKeys(app string) {
+func generatePemKeys(app string) error {
 	cmd := exec.Command("/bin/sh", "-c", "echo \"server.pem\" | ssh-keygen")
 	cmd.Dir = filepath.Join(homeDir, ".send", app)
 
 	if err := cmd.Run(); err != nil {
-		fmt.Printf("Error generating server keys for %s: %s", app, err)
-		os.Exit(1)
+		return fmt.Errorf("error generating server keys for %s: %w", app, err)
 	}
+	return nil
 }
 
-func constructBundle(app string, ip string) {
+func constructBundle(app string, ip string) error {
 	bundleDir := filepath.Join(homeDir, ".send", app)
 
-	rootDir := getDirectory("starter")
+	rootDir, err := getStore().ListDir("starter")
+	if err != nil {
+		return err
+	}
 	for _, file := range rootDir {
-		downloadFile(file, bundleDir)
+		if file.Type == "file" {
+			if err := downloadFile(file, bundleDir); err != nil {
+				return err
+			}
+		}
 	}
 
 	os.Mkdir(filepath.Join(bundleDir, "docker-compose"), os.ModePerm)
-	dockerCompose := getDirectory("starter/docker-compose")
+	dockerCompose, err := getStore().ListDir("starter/docker-compose")
+	if err != nil {
+		return err
+	}
 	for _, file := range dockerCompose {
-		downloadFile(file, filepath.Join(bundleDir, "docker-compose"))
+		if err := downloadFile(file, filepath.Join(bundleDir, "docker-compose")); err != nil {
+			return err
+		}
 	}
 
 	hostsData := []byte(fmt.Sprintf("[manager]\n%s", ip))
-	err := ioutil.WriteFile(filepath.Join(bundleDir, "hosts"), hostsData, 0644)
-	if err != nil {
-		fmt.Printf("Error writing hosts file for %s: %s", app, err)
-		os.Exit(1)
+	if err := ioutil.WriteFile(filepath.Join(bundleDir, "hosts"), hostsData, 0644); err != nil {
+		return fmt.Errorf("error writing hosts file for %s: %w", app, err)
 	}
+	return nil
 }
 
-func isDropletReady(ip string) bool {
-	// Use netcat to see if port 22 (ssh) is open on the given IP address
-	cmd := exec.Command(
-		"nc",
-		"-z",
-		ip,
-		"22",
-	)
-
-	_, err := cmd.Output()
-	return err == nil
+// writeBundleMetadata adds the app's metadata to its bundle, so it is
+// committed along with the rest.
+func writeBundleMetadata(app string, metadata appMetadata) error {
+	content, _ := json.MarshalIndent(metadata, "", "\t")
+	if err := ioutil.WriteFile(filepath.Join(homeDir, ".send", app, appMetadataFile), content, 0644); err != nil {
+		return fmt.Errorf("error writing metadata for %s: %w", app, err)
+	}
+	return nil
 }
 
-func runSwarmOnServer(app string) {
-	bundleDir := filepath.Join(homeDir, ".send", app)
+// getServerHostKey returns the server's host key once it accepts the app's
+// key over ssh, or nil while it is still initializing.
+func getServerHostKey(app string, ip string) ssh.PublicKey {
+	pemKey, err := ioutil.ReadFile(filepath.Join(homeDir, ".send", app, "server.pem"))
+	if err != nil {
+		return nil
+	}
+
+	defer zero(pemKey)
 
-	commands := []string{"python manage.py compile " + bundleDir, "python manage.py swarm lockdown", "python manage.py swarm join", "python manage.py swarm configure"}
+	var hostKey ssh.PublicKey
+	client, err := dialSSH(ip, pemKey, captureHostKey(&hostKey), 10*time.Second)
+	if err != nil {
+		return nil
+	}
+	client.Close()
+	return hostKey
+}
 
-	for _, command := range commands {
-		fmt.Printf("RUNNING SWARM COMMAND: %s\n", command)
-		cmd := exec.Command("/bin/sh", "-c", fmt.Sprintf("source venv/bin/activate; %s", command))
-		cmd.Dir = filepath.Join(homeDir, ".send", "swarm-cli")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stdout
+func swarmCommands(bundleDir string) []string {
+	return []string{"python manage.py compile " + bundleDir, "python manage.py swarm lockdown", "python manage.py swarm join", "python manage.py swarm configure"}
+}
 
-		if err := cmd.Run(); err != nil {
-			fmt.Printf("Error running swarm cli command %s: %s", command, err)
-			os.Exit(1)
-		}
+func runSwarmCommand(command string) error {
+	cmd := exec.Command("/bin/sh", "-c", fmt.Sprintf("source venv/bin/activate; %s", command))
+	cmd.Dir = filepath.Join(homeDir, ".send", "swarm-cli")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stdout
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running swarm cli command %s: %s: %w", command, err, ErrProviderFailure)
 	}
+	return nil
 }
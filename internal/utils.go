@@ -2,12 +2,14 @@ package internal
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 )
 
-func performRequest(method string, url string, body []byte) (responseBody []byte, statusCode int) {
+func performRequest(method string, url string, body []byte) (responseBody []byte, statusCode int, err error) {
 	client := &http.Client{}
 	var bodyBuffer io.Reader
 
@@ -17,18 +19,23 @@ func performRequest(method string, url string, body []byte) (responseBody []byte
 		bodyBuffer = bytes.NewBuffer(body)
 	}
 
+	token, err := getInstallationToken()
+	if err != nil {
+		return nil, 0, err
+	}
+
 	req, _ := http.NewRequest(method, url, bodyBuffer)
-	req.Header.Set("Authorization", "token "+getInstallationToken())
+	req.Header.Set("Authorization", "token "+token)
 	resp, err := client.Do(req)
 
 	if err != nil {
-		return nil, resp.StatusCode
+		return nil, 0, fmt.Errorf("%s %s: %s: %w", method, url, err, ErrStoreFailure)
 	}
 
 	defer resp.Body.Close()
 	respBody, _ := ioutil.ReadAll(resp.Body)
 
-	return respBody, resp.StatusCode
+	return respBody, resp.StatusCode, nil
 }
 
 func contains(list []string, element string) bool {
@@ -39,3 +46,9 @@ func contains(list []string, element string) bool {
 	}
 	return false
 }
+
+// shellQuote quotes s so the remote shell passes it to a command as a single
+// argument.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}